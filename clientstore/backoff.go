@@ -0,0 +1,56 @@
+package clientstore
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff configures the exponential backoff with jitter between retries.
+type Backoff struct {
+	// BaseDelay is the delay of the first retry.
+	BaseDelay time.Duration
+	// MaxDelay is the upper bound of the delay.
+	MaxDelay time.Duration
+	// Multiplier is the factor the delay grows by after each retry.
+	Multiplier float64
+	// Jitter randomizes the delay within [delay*(1-Jitter), delay*(1+Jitter)].
+	Jitter float64
+}
+
+// DefaultBackoff is the Backoff used if not configured. The zero fields of a
+// configured Backoff are filled from it, except Jitter, whose zero value
+// disables the jitter.
+var DefaultBackoff = Backoff{
+	BaseDelay:  time.Second,
+	MaxDelay:   2 * time.Minute,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+}
+
+// Duration returns the delay before the retries-th (0 based) retry.
+func (b Backoff) Duration(retries int) time.Duration {
+	// 部分配置时补全，否则 Multiplier 为0会使之后的重试都没有间隔
+	def := DefaultBackoff
+	if b.BaseDelay <= 0 {
+		b.BaseDelay = def.BaseDelay
+	}
+	if b.MaxDelay <= 0 {
+		b.MaxDelay = def.MaxDelay
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = def.Multiplier
+	}
+	delay := float64(b.BaseDelay)
+	max := float64(b.MaxDelay)
+	for ; retries > 0 && delay < max; retries-- {
+		delay *= b.Multiplier
+	}
+	if delay > max {
+		delay = max
+	}
+	delay *= 1 + b.Jitter*(rand.Float64()*2-1)
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay)
+}
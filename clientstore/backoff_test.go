@@ -0,0 +1,40 @@
+package clientstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	b := Backoff{BaseDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, time.Minute} {
+		retries := i
+		if i == 3 {
+			retries = 10
+		}
+		if got := b.Duration(retries); got != want {
+			t.Fatalf("retry %d: got %v, want %v", retries, got, want)
+		}
+	}
+
+	// 未配置的字段使用 DefaultBackoff
+	b = Backoff{BaseDelay: time.Second, MaxDelay: time.Minute}
+	prev := time.Duration(0)
+	for i := 0; i < 5; i++ {
+		d := b.Duration(i)
+		if d <= prev {
+			t.Fatalf("retry %d: %v not greater than %v", i, d, prev)
+		}
+		prev = d
+	}
+	if d := (Backoff{}).Duration(100); d != DefaultBackoff.MaxDelay {
+		t.Fatalf("got %v, want %v", d, DefaultBackoff.MaxDelay)
+	}
+
+	b = Backoff{BaseDelay: time.Second, Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := b.Duration(1); d < time.Second || d > 3*time.Second {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package clientstore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// WeightedName is the name of the metadata-aware weighted round-robin
+	// balancer, which is the default balancer of Store.
+	WeightedName = "clientstore_weighted"
+
+	// CanaryHeader routes a request only to the addresses whose version is
+	// CanaryVersion, falling back to the others if there is none.
+	// Requests without it avoid the canary addresses while others exist.
+	CanaryHeader  = "x-canary"
+	CanaryVersion = "canary"
+
+	// SubsetHeader routes a request only to the addresses matching all its
+	// "key=value" values. The key is "version", "zone", "protocol" or a tag name.
+	SubsetHeader = "x-subset"
+)
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(WeightedName, &weightedPickerBuilder{}))
+}
+
+// WithCanary marks the outgoing request to be routed to canary addresses.
+func WithCanary(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, CanaryHeader, "true")
+}
+
+// WithSubset restricts the outgoing request to the addresses whose metadata
+// key equals value.
+func WithSubset(ctx context.Context, key, value string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, SubsetHeader, key+"="+value)
+}
+
+type pickerEntry struct {
+	sc    balancer.SubConn
+	addr  string
+	md    *Metadata
+	stats *addrStats
+}
+
+// tryPick 未开启异常检测的地址总是可被选中
+func (e *pickerEntry) tryPick(now time.Time) (uint64, bool) {
+	if e.stats == nil {
+		return 0, true
+	}
+	return e.stats.tryPick(now)
+}
+
+type weightedPickerBuilder struct{}
+
+func (*weightedPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) <= 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	var entries, draining []*pickerEntry
+	for addr, sc := range readySCs {
+		e := &pickerEntry{
+			sc:    sc,
+			addr:  addr.Addr,
+			md:    addressMetadata(addr.Metadata),
+			stats: addressStats(addr.Metadata),
+		}
+		if e.md.Draining {
+			draining = append(draining, e)
+		} else {
+			entries = append(entries, e)
+		}
+	}
+	// 正在下线的地址不再接收新请求，除非全部都在下线
+	if len(entries) <= 0 {
+		entries = draining
+	}
+	// 保证同一批地址的轮询顺序稳定
+	sort.Slice(entries, func(i, j int) bool { return entries[i].addr < entries[j].addr })
+
+	return &weightedPicker{
+		entries: entries,
+		wrrs:    make(map[string]*wrr),
+	}
+}
+
+type weightedPicker struct {
+	entries []*pickerEntry
+
+	mu   sync.Mutex
+	wrrs map[string]*wrr
+}
+
+func (p *weightedPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	key, entries, err := selectSubset(p.entries, opts.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	w, ok := p.wrrs[key]
+	if !ok {
+		w = newWRR(entries)
+		p.wrrs[key] = w
+	}
+	e, probe := w.nextAvailable(time.Now())
+	p.mu.Unlock()
+
+	recordPick(ctx, e.stats, probe)
+	return e.sc, nil, nil
+}
+
+// selectSubset 根据请求头挑选可用地址，返回子集的标识用于缓存轮询状态
+func selectSubset(entries []*pickerEntry, header metadata.MD) (string, []*pickerEntry, error) {
+	if subsets := header.Get(SubsetHeader); len(subsets) > 0 {
+		sort.Strings(subsets)
+		var matched []*pickerEntry
+		for _, e := range entries {
+			ok := true
+			for _, subset := range subsets {
+				kv := strings.SplitN(subset, "=", 2)
+				if len(kv) != 2 || !e.md.match(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])) {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				matched = append(matched, e)
+			}
+		}
+		if len(matched) <= 0 {
+			return "", nil, status.Errorf(codes.Unavailable, "clientstore: no address matches subset %v", subsets)
+		}
+		return "subset:" + strings.Join(subsets, ","), matched, nil
+	}
+
+	canary := false
+	if vals := header.Get(CanaryHeader); len(vals) > 0 && vals[0] != "false" && vals[0] != "0" {
+		canary = true
+	}
+
+	var canaries, stables []*pickerEntry
+	for _, e := range entries {
+		if e.md.Version == CanaryVersion {
+			canaries = append(canaries, e)
+		} else {
+			stables = append(stables, e)
+		}
+	}
+
+	switch {
+	case canary && len(canaries) > 0:
+		return "canary", canaries, nil
+	case len(stables) > 0:
+		return "stable", stables, nil
+	default:
+		return "canary", canaries, nil
+	}
+}
+
+// wrr 平滑加权轮询，权重为0的地址仅在没有正权重地址时参与
+type wrr struct {
+	entries []*pickerEntry
+	weights []int
+	current []int
+	total   int
+}
+
+func newWRR(entries []*pickerEntry) *wrr {
+	w := &wrr{entries: entries, weights: make([]int, len(entries)), current: make([]int, len(entries))}
+	for i, e := range entries {
+		w.weights[i] = e.md.Weight
+		w.total += e.md.Weight
+	}
+	if w.total <= 0 {
+		for i := range w.weights {
+			w.weights[i] = 1
+		}
+		w.total = len(w.weights)
+	}
+	return w
+}
+
+// nextAvailable 跳过被驱逐的地址，若全部被驱逐则不再跳过
+// 选中的是探测请求时同时返回探测的标识
+func (w *wrr) nextAvailable(now time.Time) (*pickerEntry, uint64) {
+	first := w.next()
+	if probe, ok := first.tryPick(now); ok {
+		return first, probe
+	}
+	for i := 1; i < w.total; i++ {
+		e := w.next()
+		if probe, ok := e.tryPick(now); ok {
+			return e, probe
+		}
+	}
+	return first, 0
+}
+
+func (w *wrr) next() *pickerEntry {
+	best := -1
+	for i := range w.entries {
+		if w.weights[i] <= 0 {
+			continue
+		}
+		w.current[i] += w.weights[i]
+		if best < 0 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+	return w.entries[best]
+}
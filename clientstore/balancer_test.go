@@ -0,0 +1,206 @@
+package clientstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	addr string
+}
+
+func buildTestPicker(mds map[string]*Metadata) balancer.Picker {
+	readySCs := make(map[resolver.Address]balancer.SubConn)
+	for addr, md := range mds {
+		readySCs[resolver.Address{Addr: addr, Metadata: md}] = &testSubConn{addr: addr}
+	}
+	return (&weightedPickerBuilder{}).Build(readySCs)
+}
+
+func pickN(t *testing.T, p balancer.Picker, header metadata.MD, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		sc, _, err := p.Pick(context.Background(), balancer.PickOptions{Header: header})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[sc.(*testSubConn).addr]++
+	}
+	return counts
+}
+
+func TestWeightedPicker(t *testing.T) {
+	p := buildTestPicker(map[string]*Metadata{
+		"a": {Weight: 1},
+		"b": {Weight: 3},
+		"c": {Weight: 0},
+	})
+
+	counts := pickN(t, p, nil, 40)
+	if counts["a"] != 10 || counts["b"] != 30 || counts["c"] != 0 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestWeightedPickerCanary(t *testing.T) {
+	p := buildTestPicker(map[string]*Metadata{
+		"stable": {Weight: 1, Version: "v1", Zone: "z1"},
+		"canary": {Weight: 1, Version: CanaryVersion, Zone: "z2"},
+	})
+
+	if counts := pickN(t, p, nil, 10); counts["stable"] != 10 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	if counts := pickN(t, p, metadata.Pairs(CanaryHeader, "true"), 10); counts["canary"] != 10 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	if counts := pickN(t, p, metadata.Pairs(SubsetHeader, "zone=z2"), 10); counts["canary"] != 10 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	if _, _, err := p.Pick(context.Background(), balancer.PickOptions{Header: metadata.Pairs(SubsetHeader, "zone=z3")}); err == nil {
+		t.Fatal("expected error for unmatched subset")
+	}
+}
+
+func TestWeightedPickerOutlier(t *testing.T) {
+	od := newOutlierDetector(OutlierConfig{MinRequests: 2, BaseEjection: 50 * time.Millisecond})
+	readySCs := make(map[resolver.Address]balancer.SubConn)
+	for _, addr := range []string{"a", "b"} {
+		md := &outlierMeta{Metadata: &Metadata{Weight: 1}, stats: od.statsOf("test", addr)}
+		readySCs[resolver.Address{Addr: addr, Metadata: md}] = &testSubConn{addr: addr}
+	}
+	p := (&weightedPickerBuilder{}).Build(readySCs)
+
+	failure := status.Error(codes.Unavailable, "down")
+	stats := od.statsOf("test", "a")
+	stats.record(failure, time.Millisecond, 0)
+	stats.record(failure, time.Millisecond, 0)
+
+	if counts := pickN(t, p, nil, 10); counts["b"] != 10 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	if states := od.states("test"); len(states) != 2 {
+		t.Fatalf("unexpected states %v", states)
+	}
+	if !stats.state().Ejected {
+		t.Fatal("not ejected")
+	}
+
+	// 驱逐到期后只放行一个探测请求，探测成功后恢复
+	time.Sleep(60 * time.Millisecond)
+	if stats.state().Ejected {
+		t.Fatal("still ejected after the ejection expired")
+	}
+	var probe *pickRecorder
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		rec := &pickRecorder{}
+		sc, _, err := p.Pick(context.WithValue(context.Background(), pickRecorderKey{}, rec), balancer.PickOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[sc.(*testSubConn).addr]++
+		if rec.probe != 0 {
+			probe = rec
+		}
+	}
+	if counts["a"] != 1 || probe == nil || probe.stats != stats {
+		t.Fatalf("unexpected distribution %v, probe %+v", counts, probe)
+	}
+	// 驱逐前发出的请求的结果不影响探测
+	stats.record(failure, time.Millisecond, 0)
+	if counts := pickN(t, p, nil, 10); counts["a"] != 0 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	stats.record(nil, time.Millisecond, probe.probe)
+	if counts := pickN(t, p, nil, 10); counts["a"] != 5 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func buildTestHashPicker(mds map[string]*Metadata) balancer.Picker {
+	readySCs := make(map[resolver.Address]balancer.SubConn)
+	for addr, md := range mds {
+		readySCs[resolver.Address{Addr: addr, Metadata: md}] = &testSubConn{addr: addr}
+	}
+	return (&hashPickerBuilder{}).Build(readySCs)
+}
+
+func pickByKey(t *testing.T, p balancer.Picker, key string) string {
+	sc, _, err := p.Pick(WithHashKey(context.Background(), key), balancer.PickOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc.(*testSubConn).addr
+}
+
+func TestHashPicker(t *testing.T) {
+	p := buildTestHashPicker(map[string]*Metadata{
+		"a": {Weight: 1},
+		"b": {Weight: 1},
+		"c": {Weight: 2},
+	})
+
+	counts := make(map[string]int)
+	before := make(map[string]string)
+	for i := 0; i < 4000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		addr := pickByKey(t, p, key)
+		if pickByKey(t, p, key) != addr {
+			t.Fatalf("key %q is not sticky", key)
+		}
+		before[key] = addr
+		counts[addr]++
+	}
+	// 按权重大致为 1:1:2
+	if counts["a"] < 600 || counts["b"] < 600 || counts["c"] < 1400 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+
+	// 移除一个地址后，其余地址上的 key 不迁移
+	p = buildTestHashPicker(map[string]*Metadata{
+		"a": {Weight: 1},
+		"c": {Weight: 2},
+	})
+	for key, addr := range before {
+		if addr != "b" && pickByKey(t, p, key) != addr {
+			t.Fatalf("key %q moved from %q", key, addr)
+		}
+	}
+
+	sc, _, err := p.Pick(context.Background(), balancer.PickOptions{Header: metadata.Pairs(HashKeyHeader, "user-1")})
+	if err != nil || sc.(*testSubConn).addr != pickByKey(t, p, "user-1") {
+		t.Fatalf("header key not honored: %v", err)
+	}
+
+	// 没有 hash key 时按加权轮询
+	if counts := pickN(t, p, nil, 30); counts["a"] != 10 || counts["c"] != 20 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestWeightedPickerDraining(t *testing.T) {
+	p := buildTestPicker(map[string]*Metadata{
+		"a": {Weight: 1},
+		"b": {Weight: 1, Draining: true},
+	})
+	if counts := pickN(t, p, nil, 10); counts["a"] != 10 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+
+	p = buildTestPicker(map[string]*Metadata{
+		"b": {Weight: 1, Draining: true},
+	})
+	if counts := pickN(t, p, nil, 10); counts["b"] != 10 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
@@ -0,0 +1,72 @@
+package clientstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/molon/pkg/errors"
+	"google.golang.org/grpc/resolver"
+)
+
+// addrCache 是持久化到本地文件的最近一次发现的地址
+type addrCache struct {
+	UpdatedAt time.Time             `json:"updatedAt"`
+	Targets   map[string][]Endpoint `json:"targets"`
+}
+
+func loadAddrCache(path string) (map[string][]Endpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var cache addrCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, errors.Wrapf(err, "parse %q", path)
+	}
+	return cache.Targets, nil
+}
+
+// newAddrCache 复制 targetToAddrs，调用方持有锁时复制，之后在锁外写文件
+func newAddrCache(targetToAddrs map[string][]resolver.Address) *addrCache {
+	cache := &addrCache{
+		UpdatedAt: time.Now(),
+		Targets:   make(map[string][]Endpoint, len(targetToAddrs)),
+	}
+	for target, addrs := range targetToAddrs {
+		for _, addr := range addrs {
+			cache.Targets[target] = append(cache.Targets[target], Endpoint{Addr: addr.Addr, Metadata: addr.Metadata})
+		}
+	}
+	return cache
+}
+
+func (cache *addrCache) save(path string) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// 先写临时文件再重命名，避免进程中途退出留下损坏的文件
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return nil
+}
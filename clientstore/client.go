@@ -4,23 +4,41 @@ import (
 	"context"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/putil"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
+	"google.golang.org/grpc/connectivity"
 )
 
-const dialRetryRate = 1
+// stateConn 由 *grpc.ClientConn 实现，DialFunc 返回的 io.Closer 若实现了它，则可感知连接状态
+type stateConn interface {
+	GetState() connectivity.State
+	WaitForStateChange(ctx context.Context, sourceState connectivity.State) bool
+}
 
 type client struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 	doneC  chan struct{}
 
-	mu sync.RWMutex
-	cc interface{}
+	mu    sync.RWMutex
+	cc    interface{}
+	ready bool
+	// 连接状态，拨号成功前为空
+	state     connectivity.State
+	dialed    bool
+	dials     int
+	lastErr   error
+	lastErrAt time.Time
+
+	*usage
 }
 
-func newClient(ctx context.Context, logger *logrus.Entry, target string, dial func() (interface{}, io.Closer, error)) *client {
+// notify 在状态变化时调用，connected 在连接变为就绪时调用，二者都不可阻塞
+func newClient(ctx context.Context, logger *logrus.Entry, opts *storeOptions, target string, u *usage, dial func() (interface{}, io.Closer, error), notify func(), connected func()) *client {
 	ll := logger.WithFields(logrus.Fields{
 		"mod": "client",
 	})
@@ -31,28 +49,57 @@ func newClient(ctx context.Context, logger *logrus.Entry, target string, dial fu
 		ctx:    ctx,
 		cancel: cancel,
 		doneC:  doneC,
+		usage:  u,
 	}
 
 	go func() {
 		defer close(doneC)
 
-		rm := rate.NewLimiter(rate.Limit(dialRetryRate), dialRetryRate)
-		for rm.Wait(ctx) == nil {
+		retries := 0
+		for {
+			if retries > 0 {
+				if putil.Sleep(ctx, opts.backoff.Duration(retries-1)) != nil {
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
 			cc, closer, err := dial()
+			c.mu.Lock()
+			c.dials++
+			if err != nil {
+				c.lastErr, c.lastErrAt = err, time.Now()
+			} else {
+				c.cc = cc
+				c.dialed = true
+				c.state = connectivity.Idle
+			}
+			c.mu.Unlock()
 			if err != nil {
 				ll.WithError(err).Warningf("Dial")
+				retries++
 				continue
 			}
 
+			ll.Infof("Dial %q succeed", target)
+
+			healthy := c.supervise(ctx, opts, closer, notify, connected)
+
+			// 无论是ctx结束还是连接不健康，都需要关闭当前连接
 			c.mu.Lock()
-			c.cc = cc
+			c.cc = nil
+			c.ready = false
+			c.dialed = false
+			if ctx.Err() == nil {
+				c.lastErr, c.lastErrAt = errors.Errorf("connection unhealthy for over %v", opts.unhealthyTimeout), time.Now()
+			}
 			c.mu.Unlock()
+			notify()
 
-			ll.Infof("Dial %q succeed", target)
-
-			select {
-			case <-ctx.Done():
-				err := closer.Close()
+			err = closer.Close()
+			if ctx.Err() != nil {
 				if err != nil {
 					ll.WithError(err).Warningf("Ctx done, Close %q failed", target)
 				} else {
@@ -60,12 +107,78 @@ func newClient(ctx context.Context, logger *logrus.Entry, target string, dial fu
 				}
 				return
 			}
+
+			ll.Warnf("Connection of %q is unhealthy, redialing", target)
+			if healthy {
+				retries = 0
+			}
+			retries++
 		}
 	}()
 
 	return c
 }
 
+// supervise 跟踪连接状态直到ctx结束或者连接持续不健康超过 unhealthyTimeout
+// 返回期间是否曾经就绪过
+func (c *client) supervise(ctx context.Context, opts *storeOptions, closer io.Closer, notify func(), connected func()) bool {
+	sc, ok := closer.(stateConn)
+	if !ok {
+		// 无法感知连接状态的，拨号成功即认为就绪
+		c.mu.Lock()
+		c.ready = true
+		c.state = connectivity.Ready
+		c.mu.Unlock()
+		notify()
+		connected()
+
+		<-ctx.Done()
+		return true
+	}
+
+	everReady := false
+	var unhealthySince time.Time
+	state := sc.GetState()
+	for {
+		c.mu.Lock()
+		wasReady := c.ready
+		c.ready = state == connectivity.Ready
+		c.state = state
+		c.mu.Unlock()
+		notify()
+
+		switch state {
+		case connectivity.Ready:
+			everReady = true
+			if !wasReady {
+				connected()
+			}
+			unhealthySince = time.Time{}
+		case connectivity.Idle:
+			unhealthySince = time.Time{}
+		case connectivity.Shutdown:
+			return everReady
+		default:
+			if unhealthySince.IsZero() {
+				unhealthySince = time.Now()
+			}
+		}
+
+		wctx, cancel := ctx, context.CancelFunc(func() {})
+		if opts.unhealthyTimeout > 0 && !unhealthySince.IsZero() {
+			wctx, cancel = context.WithDeadline(ctx, unhealthySince.Add(opts.unhealthyTimeout))
+		}
+		changed := sc.WaitForStateChange(wctx, state)
+		cancel()
+
+		if !changed {
+			// ctx结束或者不健康超时
+			return everReady
+		}
+		state = sc.GetState()
+	}
+}
+
 func (c *client) cli() interface{} {
 	c.mu.RLock()
 	cli := c.cc
@@ -73,6 +186,73 @@ func (c *client) cli() interface{} {
 	return cli
 }
 
+func (c *client) isReady() bool {
+	c.mu.RLock()
+	ready := c.ready
+	c.mu.RUnlock()
+	return ready
+}
+
+// clientStatus 是客户端状态的快照，用于调试输出
+type clientStatus struct {
+	State     string    `json:"state"`
+	Ready     bool      `json:"ready"`
+	Dials     int       `json:"dials"`
+	LastError string    `json:"lastError,omitempty"`
+	LastErrAt time.Time `json:"lastErrorAt,omitempty"`
+	IdleFor   string    `json:"idleFor"`
+}
+
+func (c *client) status() *clientStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	st := &clientStatus{
+		State:     "DIALING",
+		Ready:     c.ready,
+		Dials:     c.dials,
+		LastErrAt: c.lastErrAt,
+		IdleFor:   c.idle().Round(time.Millisecond).String(),
+	}
+	if c.dialed {
+		st.State = c.state.String()
+	}
+	if c.lastErr != nil {
+		st.LastError = c.lastErr.Error()
+	}
+	return st
+}
+
+// usage 记录客户端的使用情况，Get/WaitFor 以及经过拦截器的每次调用都会更新
+type usage struct {
+	// 最近一次使用的时间，UnixNano
+	lastUsed int64
+	// 进行中的调用数，包括未结束的 stream
+	active int32
+}
+
+func newUsage() *usage { return &usage{lastUsed: time.Now().UnixNano()} }
+
+func (u *usage) touch() { atomic.StoreInt64(&u.lastUsed, time.Now().UnixNano()) }
+
+func (u *usage) begin() {
+	atomic.AddInt32(&u.active, 1)
+	u.touch()
+}
+
+func (u *usage) end() {
+	u.touch()
+	atomic.AddInt32(&u.active, -1)
+}
+
+// idle 有进行中的调用时为0
+func (u *usage) idle() time.Duration {
+	if atomic.LoadInt32(&u.active) > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&u.lastUsed)))
+}
+
 func (c *client) done() <-chan struct{} { return c.doneC }
 
 func (c *client) close() {
@@ -0,0 +1,157 @@
+package clientstore
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// debugState 是 Store 状态的快照
+type debugState struct {
+	Time     time.Time      `json:"time"`
+	Stale    bool           `json:"stale"`
+	Stopped  bool           `json:"stopped"`
+	Revision int64          `json:"revision,omitempty"`
+	Targets  []*debugTarget `json:"targets"`
+}
+
+type debugTarget struct {
+	Target string          `json:"target"`
+	Addrs  []*debugAddress `json:"addrs"`
+	// 未创建客户端时为nil，例如 lazy 模式下尚未使用
+	Client *clientStatus `json:"client,omitempty"`
+}
+
+type debugAddress struct {
+	Addr     string        `json:"addr"`
+	Metadata *Metadata     `json:"metadata"`
+	Outlier  *OutlierState `json:"outlier,omitempty"`
+}
+
+// DebugHandler returns an http.Handler rendering the targets, their
+// discovered addresses and metadata, the client states and the watch revision
+// of the Store. It responds with JSON if the request has "format=json" in
+// the query or accepts application/json, otherwise with a simple HTML page.
+// Mount it with server.WithHTTPHandler.
+func (cs *Store) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		state := cs.debugState()
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			encoder := json.NewEncoder(rw)
+			encoder.SetIndent("", "    ")
+			if err := encoder.Encode(state); err != nil {
+				cs.logger.WithError(err).Warnf("Encode debug state")
+			}
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := debugTemplate.Execute(rw, state); err != nil {
+			cs.logger.WithError(err).Warnf("Render debug page")
+		}
+	})
+}
+
+func (cs *Store) debugState() *debugState {
+	state := &debugState{Time: time.Now()}
+	if rw, ok := cs.w.(interface{ Revision() int64 }); ok {
+		state.Revision = rw.Revision()
+	}
+
+	cs.mu.RLock()
+	state.Stale = cs.stale
+	state.Stopped = cs.stopped
+	clients := make(map[string]*client, len(cs.targetToClient))
+	for target, client := range cs.targetToClient {
+		clients[target] = client
+	}
+	for target, addrs := range cs.targetToAddrs {
+		t := &debugTarget{Target: target}
+		for _, addr := range addrs {
+			t.Addrs = append(t.Addrs, &debugAddress{Addr: addr.Addr, Metadata: addressMetadata(addr.Metadata)})
+		}
+		state.Targets = append(state.Targets, t)
+	}
+	cs.mu.RUnlock()
+
+	// 客户端和异常检测各自有锁，不在 cs.mu 内获取
+	for _, t := range state.Targets {
+		if client, ok := clients[t.Target]; ok {
+			t.Client = client.status()
+		}
+
+		outliers := make(map[string]OutlierState)
+		for _, st := range cs.OutlierStates(t.Target) {
+			outliers[st.Addr] = st
+		}
+		sort.Slice(t.Addrs, func(i, j int) bool { return t.Addrs[i].Addr < t.Addrs[j].Addr })
+		for _, addr := range t.Addrs {
+			if st, ok := outliers[addr.Addr]; ok {
+				addr.Outlier = &st
+			}
+		}
+	}
+	sort.Slice(state.Targets, func(i, j int) bool { return state.Targets[i].Target < state.Targets[j].Target })
+	return state
+}
+
+var debugTemplate = template.Must(template.New("clientstore").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>clientstore</title>
+<style>
+body { font-family: monospace; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+.bad { color: #c00; }
+</style>
+</head>
+<body>
+<p>
+time: {{.Time.Format "2006-01-02 15:04:05.000"}}
+{{if .Revision}} | revision: {{.Revision}}{{end}}
+{{if .Stale}} | <span class="bad">stale (loaded from cache)</span>{{end}}
+{{if .Stopped}} | <span class="bad">stopped</span>{{end}}
+| <a href="?format=json">json</a>
+</p>
+{{range .Targets}}
+<h3>{{.Target}}</h3>
+{{with .Client}}
+<p>
+client: <span{{if not .Ready}} class="bad"{{end}}>{{.State}}</span>
+| dials: {{.Dials}} | idle: {{.IdleFor}}
+{{if .LastError}}| <span class="bad">last error: {{.LastError}} ({{.LastErrAt.Format "2006-01-02 15:04:05"}})</span>{{end}}
+</p>
+{{else}}
+<p>client: none</p>
+{{end}}
+<table>
+<tr><th>addr</th><th>weight</th><th>version</th><th>zone</th><th>protocol</th><th>tags</th><th>outlier</th></tr>
+{{range .Addrs}}
+<tr>
+<td>{{.Addr}}</td>
+<td>{{.Metadata.Weight}}{{if .Metadata.Draining}} <span class="bad">draining</span>{{end}}</td>
+<td>{{.Metadata.Version}}</td>
+<td>{{.Metadata.Zone}}</td>
+<td>{{.Metadata.Protocol}}</td>
+<td>{{range $k, $v := .Metadata.Tags}}{{$k}}={{$v}} {{end}}</td>
+<td>{{with .Outlier}}{{if .Ejected}}<span class="bad">ejected until {{.EjectedUntil.Format "15:04:05"}}</span>{{else}}ok{{end}} ({{.Failures}}/{{.Requests}} failed, avg {{.AvgLatency}}){{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>no targets</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,100 @@
+package clientstore
+
+import (
+	"sort"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/putil"
+	"google.golang.org/grpc/resolver"
+)
+
+// EtcdScheme is the scheme of the resolver.Builder returned by
+// NewEtcdResolverBuilder.
+const EtcdScheme = "etcd"
+
+// NewEtcdResolverBuilder creates a resolver.Builder resolving the addresses
+// registered by registry.NewRegister, so plain grpc.Dial callers can use any
+// balancer. Register it in an init function with resolver.Register, then dial
+// "etcd:///<prefix>", where prefix is what was given to registry.NewRegister.
+// The addresses carry *Metadata, so WeightedName can be used as well:
+//
+//	resolver.Register(clientstore.NewEtcdResolverBuilder(etcdCli))
+//	cc, err := grpc.Dial("etcd:///msg://boat", grpc.WithBalancerName(clientstore.WeightedName))
+func NewEtcdResolverBuilder(c *etcd.Client) resolver.Builder {
+	return &etcdResolverBuilder{c: c}
+}
+
+type etcdResolverBuilder struct {
+	c *etcd.Client
+}
+
+func (b *etcdResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	r := &etcdResolver{
+		w:      NewGRPCWatcher(b.c, target.Endpoint+"/"),
+		target: target.Endpoint,
+		cc:     cc,
+		addrs:  make(map[string]resolver.Address),
+	}
+	go r.watch()
+	return r, nil
+}
+
+func (b *etcdResolverBuilder) Scheme() string { return EtcdScheme }
+
+type etcdResolver struct {
+	w      *GRPCWatcher
+	target string
+	cc     resolver.ClientConn
+	addrs  map[string]resolver.Address
+	synced bool
+}
+
+func (r *etcdResolver) watch() {
+	retries := 0
+	for {
+		updates, err := r.w.Next()
+		if err != nil {
+			if errors.Cause(err) == ErrWatcherClosed {
+				return
+			}
+			if putil.Sleep(r.w.ctx, DefaultBackoff.Duration(retries)) != nil {
+				return
+			}
+			retries++
+			continue
+		}
+		retries = 0
+
+		changed := !r.synced
+		r.synced = true
+		for _, u := range updates {
+			// 前缀也会匹配到 svc/admin 这种其他 target 下的地址
+			if u.Target != r.target {
+				continue
+			}
+			changed = true
+			switch u.Op {
+			case Add:
+				md := internMetadata(r.addrs[u.Addr].Metadata, ParseMetadata(u.Metadata))
+				r.addrs[u.Addr] = resolver.Address{Addr: u.Addr, Metadata: md}
+			case Delete:
+				delete(r.addrs, u.Addr)
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		addrs := make([]resolver.Address, 0, len(r.addrs))
+		for _, addr := range r.addrs {
+			addrs = append(addrs, addr)
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+		r.cc.NewAddress(addrs)
+	}
+}
+
+func (*etcdResolver) ResolveNow(o resolver.ResolveNowOption) {}
+
+func (r *etcdResolver) Close() { r.w.Close() }
@@ -0,0 +1,80 @@
+package clientstore
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/molon/pkg/registry"
+	"github.com/molon/pkg/registry/registrytest"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeClientConn struct {
+	addrsC chan []resolver.Address
+}
+
+func (cc *fakeClientConn) NewAddress(addrs []resolver.Address) { cc.addrsC <- addrs }
+
+func (*fakeClientConn) NewServiceConfig(string) {}
+
+func TestEtcdResolver(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+
+	register := func(target, addr string) *registry.Register {
+		r := registry.NewRegister(etcd.NewClient(), target, addr, 10)
+		deadline := time.Now().Add(3 * time.Second)
+		for r.State().State != registry.Registered {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s/%s not registered", target, addr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return r
+	}
+	r1 := register("test://svc", "127.0.0.1:1")
+	defer r1.Close()
+	// 前缀相同的其他 target 不应被解析
+	admin := register("test://svc/admin", "127.0.0.1:3")
+	defer admin.Close()
+
+	cc := &fakeClientConn{addrsC: make(chan []resolver.Address, 10)}
+	b := NewEtcdResolverBuilder(etcd.NewClient())
+	res, err := b.Build(resolver.Target{Scheme: EtcdScheme, Endpoint: "test://svc"}, cc, resolver.BuildOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+
+	next := func() string {
+		t.Helper()
+		select {
+		case addrs := <-cc.addrsC:
+			s := make([]string, len(addrs))
+			for i, addr := range addrs {
+				s[i] = addr.Addr
+			}
+			return strings.Join(s, ",")
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for the addresses")
+		}
+		return ""
+	}
+	if got := next(); got != "127.0.0.1:1" {
+		t.Fatalf("unexpected addresses %q", got)
+	}
+
+	admin2 := register("test://svc/admin", "127.0.0.1:4")
+	defer admin2.Close()
+	r2 := register("test://svc", "127.0.0.1:2")
+	defer r2.Close()
+	if got := next(); got != "127.0.0.1:1,127.0.0.1:2" {
+		t.Fatalf("unexpected addresses %q", got)
+	}
+
+	r1.Close()
+	if got := next(); got != "127.0.0.1:2" {
+		t.Fatalf("unexpected addresses %q", got)
+	}
+}
@@ -0,0 +1,147 @@
+package clientstore
+
+import (
+	"sync"
+)
+
+type EventType uint8
+
+const (
+	TargetAdded EventType = iota + 1
+	TargetRemoved
+	AddressAdded
+	AddressRemoved
+	ClientConnected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case TargetAdded:
+		return "TargetAdded"
+	case TargetRemoved:
+		return "TargetRemoved"
+	case AddressAdded:
+		return "AddressAdded"
+	case AddressRemoved:
+		return "AddressRemoved"
+	case ClientConnected:
+		return "ClientConnected"
+	}
+	return "Unknown"
+}
+
+// Event is a change of the Store delivered to subscribers.
+type Event struct {
+	Type   EventType
+	Target string
+	// Addrs are the added or removed addresses for AddressAdded and
+	// AddressRemoved, and all the addresses of the target otherwise.
+	Addrs []string
+}
+
+// Subscribe returns a channel receiving the events of the Store in order and
+// a function to cancel the subscription. Events are queued for slow receivers
+// and never dropped. The channel is closed after cancel or Store.Stop.
+func (cs *Store) Subscribe() (<-chan *Event, func()) {
+	sub := &subscriber{
+		signalC: make(chan struct{}, 1),
+		eventC:  make(chan *Event),
+		doneC:   make(chan struct{}),
+	}
+	go sub.run()
+
+	cs.subsMu.Lock()
+	if cs.subs == nil {
+		// Store 已停止
+		cs.subsMu.Unlock()
+		sub.close()
+		return sub.eventC, func() {}
+	}
+	cs.subs[sub] = struct{}{}
+	cs.subsMu.Unlock()
+
+	return sub.eventC, func() {
+		cs.subsMu.Lock()
+		delete(cs.subs, sub)
+		cs.subsMu.Unlock()
+		sub.close()
+	}
+}
+
+// publish 不会阻塞，可在持有任何锁时调用
+func (cs *Store) publish(events ...*Event) {
+	if len(events) <= 0 {
+		return
+	}
+
+	cs.subsMu.Lock()
+	defer cs.subsMu.Unlock()
+	for sub := range cs.subs {
+		sub.push(events)
+	}
+}
+
+func (cs *Store) closeSubscribers() {
+	cs.subsMu.Lock()
+	subs := cs.subs
+	cs.subs = nil
+	cs.subsMu.Unlock()
+
+	for sub := range subs {
+		sub.close()
+	}
+}
+
+type subscriber struct {
+	mu    sync.Mutex
+	queue []*Event
+
+	signalC chan struct{}
+	eventC  chan *Event
+
+	once  sync.Once
+	doneC chan struct{}
+}
+
+func (s *subscriber) push(events []*Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, events...)
+	s.mu.Unlock()
+
+	select {
+	case s.signalC <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	defer close(s.eventC)
+
+	for {
+		s.mu.Lock()
+		var e *Event
+		if len(s.queue) > 0 {
+			e = s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+		}
+		s.mu.Unlock()
+
+		if e == nil {
+			select {
+			case <-s.doneC:
+				return
+			case <-s.signalC:
+			}
+			continue
+		}
+
+		select {
+		case <-s.doneC:
+			return
+		case s.eventC <- e:
+		}
+	}
+}
+
+func (s *subscriber) close() { s.once.Do(func() { close(s.doneC) }) }
@@ -0,0 +1,125 @@
+package clientstore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/molon/pkg/errors"
+)
+
+const defaultFileWatchInterval = 3 * time.Second
+
+var _ Watcher = (*FileWatcher)(nil)
+
+// FileWatcher is a Watcher reading targets from a JSON or YAML file, which is
+// reloaded whenever it changes. The file content is a map of target to
+// endpoints, e.g.
+//
+//	msg://boat:
+//	  - addr: 127.0.0.1:51841
+//	    metadata:
+//	      weight: 10
+type FileWatcher struct {
+	path     string
+	interval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	loaded  bool
+	modTime time.Time
+	size    int64
+	known   map[string]*Update
+}
+
+// NewFileWatcher creates a FileWatcher checking the file for changes every
+// interval. If interval is <= 0, 3 seconds will be used.
+func NewFileWatcher(path string, interval time.Duration) *FileWatcher {
+	if interval <= 0 {
+		interval = defaultFileWatchInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FileWatcher{
+		path:     path,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+		known:    make(map[string]*Update),
+	}
+}
+
+func (fw *FileWatcher) Next() ([]*Update, error) {
+	if !fw.loaded {
+		// 关闭后不再加载，避免返回的读取错误被当作发现失败
+		if fw.ctx.Err() != nil {
+			return nil, errors.WithStack(ErrWatcherClosed)
+		}
+		// 首次加载失败返回错误，由调用方稍后重试
+		updates, err := fw.reload()
+		if err != nil {
+			return nil, err
+		}
+		fw.loaded = true
+		return updates, nil
+	}
+
+	t := time.NewTicker(fw.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-fw.ctx.Done():
+			return nil, errors.WithStack(ErrWatcherClosed)
+		case <-t.C:
+		}
+
+		fi, err := os.Stat(fw.path)
+		if err != nil || (fi.ModTime().Equal(fw.modTime) && fi.Size() == fw.size) {
+			continue
+		}
+
+		// 之后的加载失败(例如文件正在被写入)则保留之前的记录，等待下次变化
+		updates, err := fw.reload()
+		if err != nil || len(updates) <= 0 {
+			continue
+		}
+		return updates, nil
+	}
+}
+
+func (fw *FileWatcher) reload() ([]*Update, error) {
+	fi, err := os.Stat(fw.path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	data, err := ioutil.ReadFile(fw.path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var targetToEndpoints map[string][]Endpoint
+	switch strings.ToLower(filepath.Ext(fw.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &targetToEndpoints)
+	default:
+		err = json.Unmarshal(data, &targetToEndpoints)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %q", fw.path)
+	}
+
+	cur := endpointsToUpdates(targetToEndpoints)
+	updates := diffUpdates(fw.known, cur)
+	fw.known = cur
+	fw.modTime = fi.ModTime()
+	fw.size = fi.Size()
+	return updates, nil
+}
+
+func (fw *FileWatcher) Close() { fw.cancel() }
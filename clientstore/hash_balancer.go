@@ -0,0 +1,168 @@
+package clientstore
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// ConsistentHashName is the name of the consistent-hash balancer, which
+	// routes the requests with the same hash key to the same address.
+	// Requests without a hash key are balanced like WeightedName.
+	ConsistentHashName = "clientstore_consistent_hash"
+
+	// HashKeyHeader carries the hash key if it is not set with WithHashKey.
+	HashKeyHeader = "x-hash-key"
+
+	// VirtualNodes is the number of points an address of weight 1 has on the
+	// hash ring.
+	VirtualNodes = 100
+)
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(ConsistentHashName, &hashPickerBuilder{}))
+}
+
+type hashKeyCtxKey struct{}
+
+// WithHashKey sets the key the consistent-hash balancer routes the request by.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtxKey{}, key)
+}
+
+func hashKeyOf(ctx context.Context, header metadata.MD) (string, bool) {
+	if key, ok := ctx.Value(hashKeyCtxKey{}).(string); ok {
+		return key, true
+	}
+	if vals := header.Get(HashKeyHeader); len(vals) > 0 {
+		return vals[0], true
+	}
+	return "", false
+}
+
+type hashPickerBuilder struct{}
+
+func (*hashPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	p := (&weightedPickerBuilder{}).Build(readySCs)
+	wp, ok := p.(*weightedPicker)
+	if !ok {
+		return p
+	}
+	return &hashPicker{
+		weighted: wp,
+		rings:    make(map[string]*hashRing),
+	}
+}
+
+type hashPicker struct {
+	// 没有 hash key 的请求按加权轮询
+	weighted *weightedPicker
+
+	mu    sync.Mutex
+	rings map[string]*hashRing
+}
+
+func (p *hashPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	key, ok := hashKeyOf(ctx, opts.Header)
+	if !ok {
+		return p.weighted.Pick(ctx, opts)
+	}
+
+	subset, entries, err := selectSubset(p.weighted.entries, opts.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	r, ok := p.rings[subset]
+	if !ok {
+		r = newHashRing(entries)
+		p.rings[subset] = r
+	}
+	p.mu.Unlock()
+
+	e, probe := r.get(key, time.Now())
+	recordPick(ctx, e.stats, probe)
+	return e.sc, nil, nil
+}
+
+type hashPoint struct {
+	hash  uint64
+	entry *pickerEntry
+}
+
+// hashRing 每个地址按权重在环上占据若干虚拟节点
+// 节点位置只由地址决定，地址增减时只有相邻区间的 key 会迁移
+type hashRing struct {
+	points []hashPoint
+	size   int
+}
+
+func newHashRing(entries []*pickerEntry) *hashRing {
+	total := 0
+	for _, e := range entries {
+		total += e.md.Weight
+	}
+
+	r := &hashRing{}
+	for _, e := range entries {
+		weight := e.md.Weight
+		if total <= 0 {
+			weight = 1
+		}
+		if weight > 0 {
+			r.size++
+		}
+		for i := 0; i < weight*VirtualNodes; i++ {
+			r.points = append(r.points, hashPoint{hash: hashString(e.addr + "#" + strconv.Itoa(i)), entry: e})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// get 返回 key 顺时针方向第一个可用的地址，若全部被驱逐则不再跳过
+// 选中的是探测请求时同时返回探测的标识
+func (r *hashRing) get(key string, now time.Time) (*pickerEntry, uint64) {
+	h := hashString(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+
+	tried := make(map[*pickerEntry]bool, r.size)
+	var first *pickerEntry
+	for i := 0; i < len(r.points) && len(tried) < r.size; i++ {
+		e := r.points[(start+i)%len(r.points)].entry
+		if tried[e] {
+			continue
+		}
+		tried[e] = true
+		if first == nil {
+			first = e
+		}
+		if probe, ok := e.tryPick(now); ok {
+			return e, probe
+		}
+	}
+	return first, 0
+}
+
+// hashString 对 fnv 结果再做 murmur3 的 fmix64，使相近的虚拟节点名在环上分散开
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	k := h.Sum64()
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
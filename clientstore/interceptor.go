@@ -0,0 +1,260 @@
+package clientstore
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/grpc/timeout"
+	"github.com/molon/pkg/retry"
+	"github.com/molon/pkg/tracing/otgrpc"
+)
+
+// InterceptorConfig configures the standard client interceptors installed by
+// WithDefaultInterceptors.
+type InterceptorConfig struct {
+	// Tracing are the options of the otgrpc client interceptors.
+	Tracing []otgrpc.TracingOption
+	// Timeout is applied to the unary calls whose ctx has no deadline.
+	// If <= 0, no default timeout is applied.
+	Timeout time.Duration
+	// ErrorHandler converts the errors returned by the calls, see
+	// errors.WithErrorHandler. If nil, the errors are returned as is.
+	ErrorHandler func(err error) error
+	// Retry retries the unary calls failing with RetryCodes, Unavailable if
+	// empty. If nil, the calls are not retried.
+	Retry      *retry.Retry
+	RetryCodes []codes.Code
+}
+
+// DefaultInterceptorConfig is a reasonable InterceptorConfig, retrying
+// Unavailable calls up to 3 times.
+var DefaultInterceptorConfig = InterceptorConfig{
+	Timeout: 10 * time.Second,
+	Retry: retry.New(
+		retry.WithN(3),
+		retry.WithDelay(100*time.Millisecond),
+		retry.WithLog(retry.NewLog(nil)),
+	),
+}
+
+// unaryInterceptors 由外到内依次为 tracing，默认超时，错误转换，重试
+func (cfg *InterceptorConfig) unaryInterceptors() []grpc.UnaryClientInterceptor {
+	interceptors := []grpc.UnaryClientInterceptor{otgrpc.UnaryClientInterceptor(cfg.Tracing...)}
+	if cfg.Timeout > 0 {
+		interceptors = append(interceptors, timeout.UnaryClientInterceptorWhenCall(cfg.Timeout))
+	}
+	if cfg.ErrorHandler != nil {
+		interceptors = append(interceptors, errors.UnaryClientInterceptor(errors.WithErrorHandler(cfg.ErrorHandler)))
+	}
+	if cfg.Retry != nil {
+		interceptors = append(interceptors, retry.UnaryClientInterceptor(cfg.Retry, cfg.RetryCodes...))
+	}
+	return interceptors
+}
+
+func (cfg *InterceptorConfig) streamInterceptors() []grpc.StreamClientInterceptor {
+	interceptors := []grpc.StreamClientInterceptor{otgrpc.StreamClientInterceptor(cfg.Tracing...)}
+	if cfg.ErrorHandler != nil {
+		interceptors = append(interceptors, errors.StreamClientInterceptor(errors.WithErrorHandler(cfg.ErrorHandler)))
+	}
+	return interceptors
+}
+
+// dialOptions 返回注入给 DialFunc 的拦截器选项
+// 记录使用情况的在最外层，其次是默认拦截器，WithUnaryInterceptors 添加的，异常检测在最内层以统计每次尝试
+// 调用没有经过这些拦截器时，即 DialFunc 用 grpc.WithUnaryInterceptor 覆盖了它们，调用 dropped
+func (o *storeOptions) dialOptions(u *usage, dropped func()) []grpc.DialOption {
+	io := &interceptorsOption{
+		unary:  []grpc.UnaryClientInterceptor{usageUnaryInterceptor(u)},
+		stream: []grpc.StreamClientInterceptor{usageStreamInterceptor(u)},
+	}
+	if o.interceptors != nil {
+		io.unary = append(io.unary, o.interceptors.unaryInterceptors()...)
+		io.stream = append(io.stream, o.interceptors.streamInterceptors()...)
+	}
+	io.unary = append(io.unary, o.unaryInterceptors...)
+	io.stream = append(io.stream, o.streamInterceptors...)
+	if o.outlier != nil {
+		io.unaryInner = append(io.unaryInner, UnaryClientInterceptor())
+		io.streamInner = append(io.streamInner, StreamClientInterceptor())
+	}
+	return append(io.dialOptions(), grpc.WithStatsHandler(&interceptedChecker{dropped: dropped}))
+}
+
+// interceptedKey 由最外层的拦截器放入 ctx，表示调用经过了 Store 的拦截器
+type interceptedKey struct{}
+
+// interceptedChecker 检查每次调用是否经过了 Store 的拦截器
+// stats.Handler 不受 grpc.WithUnaryInterceptor 覆盖的影响，总能看到调用的 ctx
+type interceptedChecker struct {
+	dropped func()
+}
+
+func (h *interceptedChecker) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	if ctx.Value(interceptedKey{}) == nil {
+		h.dropped()
+	}
+	return ctx
+}
+
+func (*interceptedChecker) HandleRPC(context.Context, stats.RPCStats) {}
+
+func (*interceptedChecker) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (*interceptedChecker) HandleConn(context.Context, stats.ConnStats) {}
+
+// usageUnaryInterceptor 记录每次调用，使 lazy 模式下正在使用的客户端不会因空闲而被关闭
+// 它在最外层，同时标记调用经过了 Store 的拦截器
+func usageUnaryInterceptor(u *usage) grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, resp interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		u.begin()
+		defer u.end()
+		return invoker(context.WithValue(ctx, interceptedKey{}, true), method, req, resp, cc, opts...)
+	}
+}
+
+// usageStreamInterceptor 在 stream 结束前都视为使用中
+func usageStreamInterceptor(u *usage) grpc.StreamClientInterceptor {
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		u.begin()
+		s, err := streamer(context.WithValue(ctx, interceptedKey{}, true), desc, cc, method, opts...)
+		if err != nil {
+			u.end()
+			return nil, err
+		}
+		// stream 结束时 grpc 会取消它的 Context
+		go func() {
+			<-s.Context().Done()
+			u.end()
+		}()
+		return s, nil
+	}
+}
+
+// AppendUnaryInterceptors returns opts, the options a DialFunc is called
+// with, plus the given interceptors chained with the ones of the Store.
+// grpc keeps only the last grpc.WithUnaryInterceptor, so a DialFunc must add
+// its own interceptors with it rather than with grpc.WithUnaryInterceptor,
+// or the interceptors of the Store are dropped. They run inside the
+// interceptors added by WithUnaryInterceptors, outside the outlier detection.
+func AppendUnaryInterceptors(opts []grpc.DialOption, interceptors ...grpc.UnaryClientInterceptor) []grpc.DialOption {
+	io := interceptorsOf(opts)
+	io.unary = append(io.unary, interceptors...)
+	return append(opts, io.dialOptions()...)
+}
+
+// AppendStreamInterceptors is like AppendUnaryInterceptors for stream
+// interceptors.
+func AppendStreamInterceptors(opts []grpc.DialOption, interceptors ...grpc.StreamClientInterceptor) []grpc.DialOption {
+	io := interceptorsOf(opts)
+	io.stream = append(io.stream, interceptors...)
+	return append(opts, io.dialOptions()...)
+}
+
+// interceptorsOption 随拦截器选项一起传给 DialFunc，记录串联前的拦截器，以便 DialFunc 追加自己的拦截器
+// 它本身不修改拨号配置
+type interceptorsOption struct {
+	grpc.EmptyDialOption
+	unary, unaryInner   []grpc.UnaryClientInterceptor
+	stream, streamInner []grpc.StreamClientInterceptor
+}
+
+// interceptorsOf 返回 opts 中最后一个 interceptorsOption 的副本
+func interceptorsOf(opts []grpc.DialOption) *interceptorsOption {
+	for i := len(opts) - 1; i >= 0; i-- {
+		if io, ok := opts[i].(*interceptorsOption); ok {
+			return &interceptorsOption{
+				unary:       append([]grpc.UnaryClientInterceptor(nil), io.unary...),
+				unaryInner:  io.unaryInner,
+				stream:      append([]grpc.StreamClientInterceptor(nil), io.stream...),
+				streamInner: io.streamInner,
+			}
+		}
+	}
+	return &interceptorsOption{}
+}
+
+func (io *interceptorsOption) dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{io}
+	unary := append(append([]grpc.UnaryClientInterceptor(nil), io.unary...), io.unaryInner...)
+	if len(unary) > 0 {
+		opts = append(opts, grpc.WithUnaryInterceptor(chainUnaryClient(unary)))
+	}
+	stream := append(append([]grpc.StreamClientInterceptor(nil), io.stream...), io.streamInner...)
+	if len(stream) > 0 {
+		opts = append(opts, grpc.WithStreamInterceptor(chainStreamClient(stream)))
+	}
+	return opts
+}
+
+// chainUnaryClient 将多个拦截器串联为一个，第一个在最外层
+func chainUnaryClient(interceptors []grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	if len(interceptors) == 1 {
+		return interceptors[0]
+	}
+	return func(
+		ctx context.Context,
+		method string,
+		req, resp interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		return interceptors[0](ctx, method, req, resp, cc, chainedInvoker(interceptors, 1, invoker), opts...)
+	}
+}
+
+func chainedInvoker(interceptors []grpc.UnaryClientInterceptor, i int, final grpc.UnaryInvoker) grpc.UnaryInvoker {
+	if i >= len(interceptors) {
+		return final
+	}
+	return func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return interceptors[i](ctx, method, req, resp, cc, chainedInvoker(interceptors, i+1, final), opts...)
+	}
+}
+
+func chainStreamClient(interceptors []grpc.StreamClientInterceptor) grpc.StreamClientInterceptor {
+	if len(interceptors) == 1 {
+		return interceptors[0]
+	}
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		return interceptors[0](ctx, desc, cc, method, chainedStreamer(interceptors, 1, streamer), opts...)
+	}
+}
+
+func chainedStreamer(interceptors []grpc.StreamClientInterceptor, i int, final grpc.Streamer) grpc.Streamer {
+	if i >= len(interceptors) {
+		return final
+	}
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return interceptors[i](ctx, desc, cc, method, chainedStreamer(interceptors, i+1, final), opts...)
+	}
+}
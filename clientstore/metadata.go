@@ -0,0 +1,85 @@
+package clientstore
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+const defaultWeight = 1
+
+// Metadata is the structured form of Update.Metadata used for routing.
+// It is carried by the resolver.Address the Store's resolver reports.
+type Metadata struct {
+	// Weight is the relative share of traffic, 1 if absent.
+	// Addresses with weight 0 are only picked when no address has a positive weight.
+	Weight   int               `json:"weight"`
+	Version  string            `json:"version,omitempty"`
+	Zone     string            `json:"zone,omitempty"`
+	Protocol string            `json:"protocol,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	// Draining addresses are only picked when all addresses are draining.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// ParseMetadata converts the metadata decoded from the registry into
+// Metadata. Unknown fields are ignored and invalid metadata results in the
+// defaults.
+func ParseMetadata(md interface{}) *Metadata {
+	m := &Metadata{Weight: defaultWeight}
+	if md == nil {
+		return m
+	}
+	if pm, ok := md.(*Metadata); ok {
+		return pm
+	}
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return &Metadata{Weight: defaultWeight}
+	}
+	if m.Weight < 0 {
+		m.Weight = 0
+	}
+	return m
+}
+
+// match 判断是否满足 key=value 的子集条件，version，zone 和 protocol 之外的 key 从 Tags 中查找
+func (m *Metadata) match(key, value string) bool {
+	switch key {
+	case "version":
+		return m.Version == value
+	case "zone":
+		return m.Zone == value
+	case "protocol":
+		return m.Protocol == value
+	default:
+		v, ok := m.Tags[key]
+		return ok && v == value
+	}
+}
+
+// internMetadata 若内容未变则复用旧指针
+// resolver.Address 会被 balancer 作为 map key，指针变化会导致重建连接
+func internMetadata(old interface{}, md *Metadata) *Metadata {
+	if om, ok := old.(*Metadata); ok && reflect.DeepEqual(om, md) {
+		return om
+	}
+	return md
+}
+
+func addressMetadata(addr interface{}) *Metadata {
+	switch md := addr.(type) {
+	case *Metadata:
+		if md != nil {
+			return md
+		}
+	case *outlierMeta:
+		if md.Metadata != nil {
+			return md.Metadata
+		}
+	}
+	return &Metadata{Weight: defaultWeight}
+}
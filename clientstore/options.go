@@ -0,0 +1,142 @@
+package clientstore
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const defaultUnhealthyTimeout = time.Minute
+
+type storeOptions struct {
+	balancerName     string
+	backoff          Backoff
+	unhealthyTimeout time.Duration
+	cacheFile        string
+	targetFilter     func(target string) bool
+	lazy             bool
+	idleTimeout      time.Duration
+	outlier          *OutlierConfig
+
+	interceptors       *InterceptorConfig
+	unaryInterceptors  []grpc.UnaryClientInterceptor
+	streamInterceptors []grpc.StreamClientInterceptor
+}
+
+func (o *storeOptions) allowed(target string) bool {
+	return o.targetFilter == nil || o.targetFilter(target)
+}
+
+// Option configures Store.
+type Option func(*storeOptions)
+
+func defaultStoreOptions() *storeOptions {
+	return &storeOptions{
+		balancerName:     WeightedName,
+		backoff:          DefaultBackoff,
+		unhealthyTimeout: defaultUnhealthyTimeout,
+	}
+}
+
+// WithBalancerName sets the balancer used by the clients the Store dials.
+// Any balancer registered to grpc can be used, e.g. ConsistentHashName or
+// "round_robin". If not set, WeightedName will be used.
+func WithBalancerName(balancerName string) Option {
+	return func(options *storeOptions) {
+		options.balancerName = balancerName
+	}
+}
+
+// WithBackoff sets the backoff between the redials of a client, and between
+// the retries of the Watcher after transient errors.
+// If not set, DefaultBackoff will be used.
+func WithBackoff(backoff Backoff) Option {
+	return func(options *storeOptions) {
+		options.backoff = backoff
+	}
+}
+
+// WithUnhealthyTimeout sets how long a client may stay out of READY before
+// it is torn down and redialed. If <= 0, clients are never redialed for
+// being unhealthy. If not set, 1 minute will be used.
+func WithUnhealthyTimeout(timeout time.Duration) Option {
+	return func(options *storeOptions) {
+		options.unhealthyTimeout = timeout
+	}
+}
+
+// WithCacheFile persists the discovered addresses to path on every change,
+// and loads them at Start as the initial state, so the Store still works if
+// discovery is unavailable when the process starts. The loaded addresses are
+// stale (see Store.IsStale) until the Watcher syncs for the first time.
+func WithCacheFile(path string) Option {
+	return func(options *storeOptions) {
+		options.cacheFile = path
+	}
+}
+
+// WithTargetFilter restricts the Store to the targets for which filter
+// returns true, others are neither tracked nor dialed.
+func WithTargetFilter(filter func(target string) bool) Option {
+	return func(options *storeOptions) {
+		options.targetFilter = filter
+	}
+}
+
+// WithTargets restricts the Store to the given targets.
+func WithTargets(targets ...string) Option {
+	allowed := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		allowed[target] = true
+	}
+	return WithTargetFilter(func(target string) bool {
+		return allowed[target]
+	})
+}
+
+// WithLazy makes the Store dial a target only on its first Get or WaitFor,
+// and close the client after it has not been used for idleTimeout. Each call
+// made through the client counts as a use, and so does an open stream until
+// it ends, unless a DialFunc drops the interceptors of the Store.
+// If idleTimeout <= 0, the clients are never closed for being idle.
+func WithLazy(idleTimeout time.Duration) Option {
+	return func(options *storeOptions) {
+		options.lazy = true
+		options.idleTimeout = idleTimeout
+	}
+}
+
+// WithOutlierDetection tracks the error rate and latency of every address and
+// temporarily ejects the outliers from the balancer, re-admitting them by
+// probing after a growing ejection window. Zero fields of cfg take the values
+// of DefaultOutlierConfig. The calls are tracked by UnaryClientInterceptor and
+// StreamClientInterceptor, which the Store installs on its clients.
+func WithOutlierDetection(cfg OutlierConfig) Option {
+	return func(options *storeOptions) {
+		options.outlier = &cfg
+	}
+}
+
+// WithDefaultInterceptors installs the standard client interceptors on every
+// client the Store dials, outermost first: tracing, default timeout, error
+// conversion and retry. Use DefaultInterceptorConfig for the defaults.
+func WithDefaultInterceptors(cfg InterceptorConfig) Option {
+	return func(options *storeOptions) {
+		options.interceptors = &cfg
+	}
+}
+
+// WithUnaryInterceptors adds unary client interceptors to every client the
+// Store dials, inside the ones of WithDefaultInterceptors, in the given order.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryClientInterceptor) Option {
+	return func(options *storeOptions) {
+		options.unaryInterceptors = append(options.unaryInterceptors, interceptors...)
+	}
+}
+
+// WithStreamInterceptors is like WithUnaryInterceptors for stream interceptors.
+func WithStreamInterceptors(interceptors ...grpc.StreamClientInterceptor) Option {
+	return func(options *storeOptions) {
+		options.streamInterceptors = append(options.streamInterceptors, interceptors...)
+	}
+}
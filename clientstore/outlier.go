@@ -0,0 +1,338 @@
+package clientstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OutlierConfig configures the per-address outlier ejection of Store.
+type OutlierConfig struct {
+	// Interval is the window the error rate and latency are computed over.
+	Interval time.Duration
+	// MinRequests is the number of requests in a window before an address
+	// can be ejected.
+	MinRequests int
+	// MaxErrorRate ejects an address whose rate of FailureCodes exceeds it.
+	MaxErrorRate float64
+	// MaxLatency ejects an address whose average latency exceeds it.
+	// If <= 0, latency is not considered.
+	MaxLatency time.Duration
+	// BaseEjection is the first ejection duration, doubled on each
+	// consecutive ejection up to MaxEjection.
+	BaseEjection time.Duration
+	MaxEjection  time.Duration
+	// FailureCodes are the codes counted as failures.
+	FailureCodes []codes.Code
+}
+
+// DefaultOutlierConfig is the OutlierConfig used by WithOutlierDetection if
+// the given one has zero values.
+var DefaultOutlierConfig = OutlierConfig{
+	Interval:     10 * time.Second,
+	MinRequests:  10,
+	MaxErrorRate: 0.5,
+	BaseEjection: 30 * time.Second,
+	MaxEjection:  5 * time.Minute,
+	FailureCodes: []codes.Code{codes.Unavailable, codes.Internal},
+}
+
+// OutlierState is the outlier ejection state of an address.
+type OutlierState struct {
+	Addr         string        `json:"addr"`
+	Ejected      bool          `json:"ejected"`
+	EjectedUntil time.Time     `json:"ejectedUntil,omitempty"`
+	Ejections    int           `json:"ejections"`
+	Requests     int           `json:"requests"`
+	Failures     int           `json:"failures"`
+	AvgLatency   time.Duration `json:"avgLatency"`
+}
+
+type outlierDetector struct {
+	cfg      OutlierConfig
+	failures map[codes.Code]bool
+
+	mu    sync.Mutex
+	stats map[string]map[string]*addrStats
+}
+
+func newOutlierDetector(cfg OutlierConfig) *outlierDetector {
+	def := DefaultOutlierConfig
+	if cfg.Interval <= 0 {
+		cfg.Interval = def.Interval
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = def.MinRequests
+	}
+	if cfg.MaxErrorRate <= 0 {
+		cfg.MaxErrorRate = def.MaxErrorRate
+	}
+	if cfg.BaseEjection <= 0 {
+		cfg.BaseEjection = def.BaseEjection
+	}
+	if cfg.MaxEjection < cfg.BaseEjection {
+		cfg.MaxEjection = cfg.BaseEjection
+	}
+	if len(cfg.FailureCodes) <= 0 {
+		cfg.FailureCodes = def.FailureCodes
+	}
+
+	od := &outlierDetector{
+		cfg:      cfg,
+		failures: make(map[codes.Code]bool),
+		stats:    make(map[string]map[string]*addrStats),
+	}
+	for _, c := range cfg.FailureCodes {
+		od.failures[c] = true
+	}
+	return od
+}
+
+// statsOf 获取或创建地址的统计
+func (od *outlierDetector) statsOf(target, addr string) *addrStats {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	if od.stats[target] == nil {
+		od.stats[target] = make(map[string]*addrStats)
+	}
+	s, ok := od.stats[target][addr]
+	if !ok {
+		s = &addrStats{od: od, addr: addr}
+		od.stats[target][addr] = s
+	}
+	return s
+}
+
+// retain 只保留 target 仍然存在的地址的统计
+func (od *outlierDetector) retain(target string, addrs []string) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+	for addr := range od.stats[target] {
+		if !keep[addr] {
+			delete(od.stats[target], addr)
+		}
+	}
+	if len(od.stats[target]) <= 0 {
+		delete(od.stats, target)
+	}
+}
+
+func (od *outlierDetector) states(target string) []OutlierState {
+	od.mu.Lock()
+	stats := make([]*addrStats, 0, len(od.stats[target]))
+	for _, s := range od.stats[target] {
+		stats = append(stats, s)
+	}
+	od.mu.Unlock()
+
+	states := make([]OutlierState, 0, len(stats))
+	for _, s := range stats {
+		states = append(states, s.state())
+	}
+	return states
+}
+
+type addrStats struct {
+	od   *outlierDetector
+	addr string
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	failures    int
+	latency     time.Duration
+
+	ejections    int
+	ejectedUntil time.Time
+	probeStart   time.Time
+	// 当前探测请求的标识，只有它的结果能结束驱逐
+	probe    uint64
+	probeSeq uint64
+}
+
+// tryPick 判断地址是否可被选中，驱逐到期后只放行一个探测请求，并返回它的标识
+func (s *addrStats) tryPick(now time.Time) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ejectedUntil.IsZero() {
+		return 0, true
+	}
+	if now.Before(s.ejectedUntil) {
+		return 0, false
+	}
+	// 探测请求迟迟没有结果的，允许重新探测
+	if s.probe != 0 && now.Sub(s.probeStart) < s.od.cfg.Interval {
+		return 0, false
+	}
+	s.probeSeq++
+	s.probe = s.probeSeq
+	s.probeStart = now
+	return s.probe, true
+}
+
+// record 记录请求的结果，probe 为选中时 tryPick 返回的标识
+func (s *addrStats) record(err error, latency time.Duration, probe uint64) {
+	failed := err != nil && s.od.failures[status.Code(err)]
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.ejectedUntil.IsZero() {
+		if probe == 0 || probe != s.probe {
+			// 驱逐前已发出的请求，或已被放弃的探测
+			return
+		}
+		s.probe = 0
+		s.probeStart = time.Time{}
+		if failed {
+			s.eject(now)
+		} else {
+			s.ejectedUntil = time.Time{}
+			s.reset(now)
+		}
+		return
+	}
+
+	if now.Sub(s.windowStart) > s.od.cfg.Interval {
+		// 一个完整的窗口内都未被驱逐，则驱逐时长重新开始增长
+		if s.requests >= s.od.cfg.MinRequests {
+			s.ejections = 0
+		}
+		s.reset(now)
+	}
+	s.requests++
+	s.latency += latency
+	if failed {
+		s.failures++
+	}
+
+	if s.requests < s.od.cfg.MinRequests {
+		return
+	}
+	if float64(s.failures)/float64(s.requests) >= s.od.cfg.MaxErrorRate ||
+		(s.od.cfg.MaxLatency > 0 && s.latency/time.Duration(s.requests) >= s.od.cfg.MaxLatency) {
+		s.eject(now)
+	}
+}
+
+func (s *addrStats) eject(now time.Time) {
+	d := s.od.cfg.BaseEjection
+	for i := 0; i < s.ejections && d < s.od.cfg.MaxEjection; i++ {
+		d *= 2
+	}
+	if d > s.od.cfg.MaxEjection {
+		d = s.od.cfg.MaxEjection
+	}
+	s.ejections++
+	s.ejectedUntil = now.Add(d)
+	s.reset(now)
+}
+
+func (s *addrStats) reset(now time.Time) {
+	s.windowStart = now
+	s.requests = 0
+	s.failures = 0
+	s.latency = 0
+}
+
+func (s *addrStats) state() OutlierState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 驱逐到期后等待探测结果期间，地址已可被选中，不再视为被驱逐
+	st := OutlierState{
+		Addr:         s.addr,
+		Ejected:      time.Now().Before(s.ejectedUntil),
+		EjectedUntil: s.ejectedUntil,
+		Ejections:    s.ejections,
+		Requests:     s.requests,
+		Failures:     s.failures,
+	}
+	if s.requests > 0 {
+		st.AvgLatency = s.latency / time.Duration(s.requests)
+	}
+	return st
+}
+
+// outlierMeta 在开启异常检测时作为 resolver.Address.Metadata，使 picker 能找到地址的统计
+type outlierMeta struct {
+	*Metadata
+	stats *addrStats
+}
+
+func addressStats(addr interface{}) *addrStats {
+	if om, ok := addr.(*outlierMeta); ok {
+		return om.stats
+	}
+	return nil
+}
+
+type pickRecorderKey struct{}
+
+// pickRecorder 由拦截器放入ctx，picker 将选中地址的统计填入其中
+type pickRecorder struct {
+	stats *addrStats
+	probe uint64
+}
+
+func recordPick(ctx context.Context, stats *addrStats, probe uint64) {
+	if rec, ok := ctx.Value(pickRecorderKey{}).(*pickRecorder); ok {
+		rec.stats = stats
+		rec.probe = probe
+	}
+}
+
+// UnaryClientInterceptor feeds the outcome and latency of the calls to the
+// outlier detection of the Store the call is routed by. A Store with
+// WithOutlierDetection installs it on its clients.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, resp interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		rec := &pickRecorder{}
+		start := time.Now()
+		err := invoker(context.WithValue(ctx, pickRecorderKey{}, rec), method, req, resp, cc, opts...)
+		if rec.stats != nil {
+			rec.stats.record(err, time.Since(start), rec.probe)
+		}
+		return err
+	}
+}
+
+// StreamClientInterceptor is like UnaryClientInterceptor, but only the
+// result of creating the stream is taken into account.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		rec := &pickRecorder{}
+		start := time.Now()
+		cs, err := streamer(context.WithValue(ctx, pickRecorderKey{}, rec), desc, cc, method, opts...)
+		if rec.stats != nil {
+			rec.stats.record(err, time.Since(start), rec.probe)
+		}
+		return cs, err
+	}
+}
@@ -0,0 +1,163 @@
+package clientstore
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// storeScheme 用于 Store 自身拨号，目标形如 clientstore://<storeID>/<target>
+const storeScheme = "clientstore"
+
+var (
+	storeSeq uint64
+
+	resolversMu sync.RWMutex
+	resolvers   = make(map[string]*storeResolver)
+)
+
+func init() {
+	resolver.Register(&storeResolverBuilder{})
+}
+
+type storeResolverBuilder struct{}
+
+func (*storeResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	resolversMu.RLock()
+	r, ok := resolvers[target.Authority]
+	resolversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("clientstore: store %q not found", target.Authority)
+	}
+	return r.watch(target.Endpoint, cc), nil
+}
+
+func (*storeResolverBuilder) Scheme() string { return storeScheme }
+
+// storeResolver 将 Store 发现的地址提供给 grpc，使拨号不再依赖具体的服务发现后端
+// 它自己维护一份地址副本，避免和 Store 的锁交织
+type storeResolver struct {
+	id string
+	// 开启异常检测时不为nil
+	od *outlierDetector
+
+	mu            sync.Mutex
+	targetToAddrs map[string][]resolver.Address
+	targetToCCs   map[string]map[*ccResolver]struct{}
+}
+
+func newStoreResolver(od *outlierDetector) *storeResolver {
+	r := &storeResolver{
+		id:            strconv.FormatUint(atomic.AddUint64(&storeSeq, 1), 10),
+		od:            od,
+		targetToAddrs: make(map[string][]resolver.Address),
+		targetToCCs:   make(map[string]map[*ccResolver]struct{}),
+	}
+
+	resolversMu.Lock()
+	resolvers[r.id] = r
+	resolversMu.Unlock()
+	return r
+}
+
+// dialTarget 返回 target 对应的可直接用于 grpc.Dial 的地址
+func (r *storeResolver) dialTarget(target string) string {
+	return fmt.Sprintf("%s://%s/%s", storeScheme, r.id, target)
+}
+
+// set 更新 target 的全量地址，addrs 为空表示 target 已消失
+func (r *storeResolver) set(target string, addrs []resolver.Address) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.od != nil {
+		addrs = r.withStats(target, addrs)
+	}
+
+	if len(addrs) <= 0 {
+		delete(r.targetToAddrs, target)
+	} else {
+		r.targetToAddrs[target] = addrs
+	}
+
+	for ccr := range r.targetToCCs[target] {
+		ccr.cc.NewAddress(addrs)
+	}
+}
+
+// withStats 给地址附带异常检测的统计，Metadata 未变化的复用之前的值
+func (r *storeResolver) withStats(target string, addrs []resolver.Address) []resolver.Address {
+	prev := make(map[string]*outlierMeta)
+	for _, addr := range r.targetToAddrs[target] {
+		if om, ok := addr.Metadata.(*outlierMeta); ok {
+			prev[addr.Addr] = om
+		}
+	}
+
+	wrapped := make([]resolver.Address, 0, len(addrs))
+	names := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		md := addressMetadata(addr.Metadata)
+		om, ok := prev[addr.Addr]
+		if !ok || om.Metadata != md {
+			om = &outlierMeta{Metadata: md, stats: r.od.statsOf(target, addr.Addr)}
+		}
+		addr.Metadata = om
+		wrapped = append(wrapped, addr)
+		names = append(names, addr.Addr)
+	}
+	r.od.retain(target, names)
+	return wrapped
+}
+
+func (r *storeResolver) addrs(target string) []resolver.Address {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.targetToAddrs[target]
+}
+
+func (r *storeResolver) watch(target string, cc resolver.ClientConn) *ccResolver {
+	ccr := &ccResolver{r: r, target: target, cc: cc}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.targetToCCs[target] == nil {
+		r.targetToCCs[target] = make(map[*ccResolver]struct{})
+	}
+	r.targetToCCs[target][ccr] = struct{}{}
+
+	if addrs, ok := r.targetToAddrs[target]; ok {
+		cc.NewAddress(addrs)
+	}
+	return ccr
+}
+
+func (r *storeResolver) remove(ccr *ccResolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.targetToCCs[ccr.target], ccr)
+	if len(r.targetToCCs[ccr.target]) <= 0 {
+		delete(r.targetToCCs, ccr.target)
+	}
+}
+
+func (r *storeResolver) close() {
+	resolversMu.Lock()
+	delete(resolvers, r.id)
+	resolversMu.Unlock()
+}
+
+type ccResolver struct {
+	r      *storeResolver
+	target string
+	cc     resolver.ClientConn
+}
+
+func (*ccResolver) ResolveNow(o resolver.ResolveNowOption) {}
+
+func (ccr *ccResolver) Close() { ccr.r.remove(ccr) }
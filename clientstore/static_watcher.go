@@ -0,0 +1,66 @@
+package clientstore
+
+import (
+	"context"
+
+	"github.com/molon/pkg/errors"
+)
+
+// Endpoint describes one address of a target for the watchers that are not
+// backed by etcd.
+type Endpoint struct {
+	Addr     string      `json:"addr"`
+	Metadata interface{} `json:"metadata,omitempty"`
+}
+
+func endpointsToUpdates(targetToEndpoints map[string][]Endpoint) map[string]*Update {
+	updates := make(map[string]*Update)
+	for target, eps := range targetToEndpoints {
+		for _, ep := range eps {
+			if len(target) < 1 || len(ep.Addr) < 1 {
+				continue
+			}
+			updates[updateKey(target, ep.Addr)] = &Update{
+				Op:       Add,
+				Addr:     ep.Addr,
+				Target:   target,
+				Metadata: ep.Metadata,
+			}
+		}
+	}
+	return updates
+}
+
+var _ Watcher = (*StaticWatcher)(nil)
+
+// StaticWatcher is a Watcher with a fixed list of targets and addresses.
+type StaticWatcher struct {
+	updates []*Update
+	sent    bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewStaticWatcher creates a Watcher that reports the given endpoints once and
+// never changes afterwards.
+func NewStaticWatcher(targetToEndpoints map[string][]Endpoint) *StaticWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	sw := &StaticWatcher{ctx: ctx, cancel: cancel}
+	for _, u := range endpointsToUpdates(targetToEndpoints) {
+		sw.updates = append(sw.updates, u)
+	}
+	return sw
+}
+
+func (sw *StaticWatcher) Next() ([]*Update, error) {
+	if !sw.sent && sw.ctx.Err() == nil {
+		sw.sent = true
+		return sw.updates, nil
+	}
+
+	<-sw.ctx.Done()
+	return nil, errors.WithStack(ErrWatcherClosed)
+}
+
+func (sw *StaticWatcher) Close() { sw.cancel() }
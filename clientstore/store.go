@@ -3,56 +3,123 @@ package clientstore
 import (
 	"context"
 	"io"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/resolver"
 
 	etcd "github.com/coreos/etcd/clientv3"
-	etcdnaming "github.com/coreos/etcd/clientv3/naming"
 	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/putil"
+	"github.com/molon/pkg/wait"
 )
 
+// DialFunc dials target with the given options, which resolve target to the
+// addresses the Store has discovered. target is not the discovered target name
+// but a dial target of the Store's own resolver, pass it to grpc.Dial as-is.
+// The io.Closer is usually the *grpc.ClientConn.
+//
+// The options also carry the client interceptors of the Store, chained into
+// one. A DialFunc with interceptors of its own adds them to the options with
+// AppendUnaryInterceptors and AppendStreamInterceptors, which keep the
+// interceptors of the Store in the chain. grpc keeps only the last
+// grpc.WithUnaryInterceptor, so adding them with it drops the interceptors of
+// the Store, which the Store warns about once on the first call.
 type DialFunc func(target string, opts ...grpc.DialOption) (interface{}, io.Closer, error)
 
 type Store struct {
-	mu sync.RWMutex
+	mu      sync.RWMutex
+	stopped bool
+	// 当前地址来自缓存文件，尚未与服务发现同步
+	stale bool
 
-	logger       *logrus.Entry
-	etcdCli      *etcd.Client
-	targetPrefix string
-	dial         DialFunc
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	opts   *storeOptions
+	logger *logrus.Entry
+	dial   DialFunc
+	// DialFunc 覆盖了 Store 的拦截器时只警告一次
+	droppedOnce sync.Once
+
+	// 状态变化时唤醒 WaitFor
+	waiter  *wait.Waiter
+	notifyC chan struct{}
+
+	// 事件订阅者
+	subsMu sync.Mutex
+	subs   map[*subscriber]struct{}
 
 	// 服务发现
-	w *GRPCWatcher
+	w Watcher
+
+	// 为拨号提供地址
+	r *storeResolver
+	// 地址异常检测，未开启时为nil
+	od *outlierDetector
 
 	// 当前存在的客户端
 	targetToClient map[string]*client
 
+	// lazy 模式下被使用过的target
+	wanted map[string]bool
+
 	// 当前发现的target和地址记录
-	targetToAddrs map[string][]grpc.Address
+	targetToAddrs map[string][]resolver.Address
 }
 
+// NewStore creates a Store discovering targets under targetPrefix in etcd.
 func NewStore(
 	logger *logrus.Logger,
 	etcdCli *etcd.Client,
 	targetPrefix string,
 	dial DialFunc,
+	opts ...Option,
 ) *Store {
+	return NewStoreWithWatcher(logger, NewGRPCWatcher(etcdCli, targetPrefix), dial, opts...)
+}
+
+// NewStoreWithWatcher creates a Store discovering targets with the given Watcher.
+func NewStoreWithWatcher(
+	logger *logrus.Logger,
+	w Watcher,
+	dial DialFunc,
+	opts ...Option,
+) *Store {
+	sOpts := defaultStoreOptions()
+	for _, opt := range opts {
+		opt(sOpts)
+	}
+
 	ll := logger.WithFields(logrus.Fields{
 		"pkg": "clientstore",
 		"mod": "store",
 	})
 
+	var od *outlierDetector
+	if sOpts.outlier != nil {
+		od = newOutlierDetector(*sOpts.outlier)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Store{
+		ctx:            ctx,
+		cancel:         cancel,
+		opts:           sOpts,
 		logger:         ll,
-		etcdCli:        etcdCli,
-		targetPrefix:   targetPrefix,
 		dial:           dial,
-		w:              NewGRPCWatcher(etcdCli, targetPrefix),
-		targetToAddrs:  make(map[string][]grpc.Address),
+		waiter:         wait.NewWaiter(),
+		notifyC:        make(chan struct{}, 1),
+		subs:           make(map[*subscriber]struct{}),
+		w:              w,
+		r:              newStoreResolver(od),
+		od:             od,
+		targetToAddrs:  make(map[string][]resolver.Address),
 		targetToClient: make(map[string]*client),
+		wanted:         make(map[string]bool),
 	}
 }
 
@@ -60,13 +127,42 @@ func (cs *Store) Start() error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	if cs.opts.cacheFile != "" {
+		cs.loadCache()
+	}
+
 	go func() {
 		for {
-			// 在watcher关闭之后会触发err
-			if err := cs.watchAddrUpdates(); err != nil {
-				if errors.Cause(err) != ErrWatcherClosed {
-					cs.logger.WithError(err).Warnf("watchAddrUpdates")
-				}
+			select {
+			case <-cs.ctx.Done():
+				return
+			case <-cs.notifyC:
+				cs.waiter.Broadcast(nil)
+			}
+		}
+	}()
+
+	if cs.opts.lazy && cs.opts.idleTimeout > 0 {
+		go cs.closeIdleClients()
+	}
+
+	go func() {
+		retries := 0
+		for {
+			// 在watcher关闭之后会触发ErrWatcherClosed，其他错误则退避后重试
+			err := cs.watchAddrUpdates()
+			if err == nil {
+				retries = 0
+				continue
+			}
+			if errors.Cause(err) == ErrWatcherClosed {
+				return
+			}
+
+			delay := cs.opts.backoff.Duration(retries)
+			retries++
+			cs.logger.WithError(err).Warnf("watchAddrUpdates, retry #%d in %v", retries, delay)
+			if putil.Sleep(cs.ctx, delay) != nil {
 				return
 			}
 		}
@@ -76,7 +172,7 @@ func (cs *Store) Start() error {
 
 func (cs *Store) Stop() {
 	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	cs.stopped = true
 
 	// 关闭watcher
 	cs.w.Close()
@@ -85,13 +181,26 @@ func (cs *Store) Stop() {
 	for _, client := range cs.targetToClient {
 		client.close()
 	}
+	cs.mu.Unlock()
+
+	cs.r.close()
+
+	// 唤醒所有 WaitFor，须在释放 cs.mu 之后，因为 WaitFor 会持有 waiter 的锁再去拿 cs.mu
+	cs.waiter.Close(nil)
+	cs.closeSubscribers()
+	cs.cancel()
 }
 
-func (cs *Store) Get(target string) (interface{}, bool) {
-	cs.mu.RLock()
-	client, ok := cs.targetToClient[target]
-	cs.mu.RUnlock()
+// notify 不会阻塞，可在持有任何锁时调用
+func (cs *Store) notify() {
+	select {
+	case cs.notifyC <- struct{}{}:
+	default:
+	}
+}
 
+func (cs *Store) Get(target string) (interface{}, bool) {
+	client, ok := cs.useClient(target)
 	if ok {
 		return client.cli(), ok
 	}
@@ -99,49 +208,147 @@ func (cs *Store) Get(target string) (interface{}, bool) {
 	return nil, false
 }
 
+// OutlierStates returns the outlier ejection state of the addresses of target.
+// It returns nil if the Store is created without WithOutlierDetection.
+func (cs *Store) OutlierStates(target string) []OutlierState {
+	if cs.od == nil {
+		return nil
+	}
+	return cs.od.states(target)
+}
+
+// IsStale reports whether the discovered addresses are still the ones loaded
+// from the cache file, i.e. the Watcher has not synced successfully yet.
+func (cs *Store) IsStale() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.stale
+}
+
+// loadCache 加载缓存的地址作为初始状态，并标记为过期
+func (cs *Store) loadCache() {
+	targetToEndpoints, err := loadAddrCache(cs.opts.cacheFile)
+	if err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			cs.logger.WithError(err).Warnf("Load cache %q", cs.opts.cacheFile)
+		}
+		return
+	}
+
+	var updates []*Update
+	for _, u := range endpointsToUpdates(targetToEndpoints) {
+		updates = append(updates, u)
+	}
+	if len(updates) <= 0 {
+		return
+	}
+
+	cs.stale = true
+	cs.applyUpdates(updates)
+	cs.logger.Warnf("Loaded %d stale addresses from cache %q until discovery syncs", len(updates), cs.opts.cacheFile)
+}
+
 func (cs *Store) watchAddrUpdates() error {
 	updates, err := cs.w.Next()
 	if err != nil {
 		return err
 	}
 
+	cache, err := cs.applyWatched(updates)
+	if err != nil {
+		return err
+	}
+	// 写文件不持有 cs.mu，以免 Get 等等待磁盘；只有 watch 循环调用这里，写入是串行的
+	if cache != nil {
+		if err := cache.save(cs.opts.cacheFile); err != nil {
+			cs.logger.WithError(err).Warnf("Save cache %q", cs.opts.cacheFile)
+		}
+	}
+	return nil
+}
+
+// applyWatched 应用 Watcher 的更新，需要持久化时返回地址的副本
+func (cs *Store) applyWatched(updates []*Update) (*addrCache, error) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	if cs.stopped {
+		return nil, errors.WithStack(ErrWatcherClosed)
+	}
+
+	if cs.stale {
+		// 首次同步得到的是全量记录，缓存中多出的地址需要删除
+		fresh := make(map[string]bool)
+		for _, update := range updates {
+			if update.Op == Add {
+				fresh[updateKey(update.Target, update.Addr)] = true
+			}
+		}
+		for target, addrs := range cs.targetToAddrs {
+			for _, addr := range addrs {
+				if !fresh[updateKey(target, addr.Addr)] {
+					updates = append(updates, &Update{Op: Delete, Addr: addr.Addr, Target: target})
+				}
+			}
+		}
+		cs.stale = false
+		cs.logger.Infof("Discovery synced, stale addresses replaced")
+	}
+
+	if cs.applyUpdates(updates) && cs.opts.cacheFile != "" {
+		return newAddrCache(cs.targetToAddrs), nil
+	}
+	return nil, nil
+}
+
+// applyUpdates 须持有 cs.mu，返回地址是否有变化
+func (cs *Store) applyUpdates(updates []*Update) bool {
+	defer cs.notify()
+
+	changed := make(map[string]bool)
+	// 记录本批次变化前 target 的地址，用于生成 target 级别的事件
+	before := make(map[string][]string)
+	var addrEvents []*Event
 	for _, update := range updates {
-		if len(update.Target) < 1 {
+		if len(update.Target) < 1 || !cs.opts.allowed(update.Target) {
 			continue
 		}
 
 		target := update.Target
+		if _, ok := before[target]; !ok {
+			before[target] = addrsOf(cs.targetToAddrs[target])
+		}
 
-		address := grpc.Address{
+		address := resolver.Address{
 			Addr:     update.Addr,
-			Metadata: update.Metadata,
+			Metadata: ParseMetadata(update.Metadata),
 		}
 
 		switch update.Op {
-		case naming.Add:
+		case Add:
+			// 已存在的地址只更新其Metadata
 			var exist bool
-			for _, addr := range cs.targetToAddrs[target] {
-				if addr == address {
+			for i, addr := range cs.targetToAddrs[target] {
+				if addr.Addr == address.Addr {
 					exist = true
-					cs.logger.Infoln("The name resolver wanted to add an existing address: ", addr)
+					address.Metadata = internMetadata(addr.Metadata, address.Metadata.(*Metadata))
+					cs.targetToAddrs[target][i] = address
 					break
 				}
 			}
-			if exist {
-				continue
+			if !exist {
+				cs.targetToAddrs[target] = append(cs.targetToAddrs[target], address)
+				addrEvents = append(addrEvents, &Event{Type: AddressAdded, Target: target, Addrs: []string{address.Addr}})
 			}
-
-			cs.targetToAddrs[target] = append(cs.targetToAddrs[target], address)
-		case naming.Delete:
+			changed[target] = true
+		case Delete:
 			addrs, ok := cs.targetToAddrs[target]
 			if ok {
 				for i, addr := range addrs {
-					if addr == address {
+					if addr.Addr == address.Addr {
 						copy(addrs[i:], addrs[i+1:])
 						addrs = addrs[:len(addrs)-1]
+						addrEvents = append(addrEvents, &Event{Type: AddressRemoved, Target: target, Addrs: []string{address.Addr}})
 						break
 					}
 				}
@@ -150,12 +357,31 @@ func (cs *Store) watchAddrUpdates() error {
 				} else {
 					cs.targetToAddrs[target] = addrs
 				}
+				changed[target] = true
 			}
 		default:
 			cs.logger.Errorln("Unknown update.Op ", update.Op)
 		}
 	}
 
+	for target := range changed {
+		addrs := make([]resolver.Address, len(cs.targetToAddrs[target]))
+		copy(addrs, cs.targetToAddrs[target])
+		cs.r.set(target, addrs)
+	}
+
+	var added, removed []*Event
+	for target, addrs := range before {
+		cur, ok := cs.targetToAddrs[target]
+		switch {
+		case ok && len(addrs) <= 0:
+			added = append(added, &Event{Type: TargetAdded, Target: target, Addrs: addrsOf(cur)})
+		case !ok && len(addrs) > 0:
+			removed = append(removed, &Event{Type: TargetRemoved, Target: target, Addrs: addrs})
+		}
+	}
+	cs.publish(append(append(added, addrEvents...), removed...)...)
+
 	// targetToClient 有 targetToAddrs 无，则减少
 	for target, client := range cs.targetToClient {
 		_, ok := cs.targetToAddrs[target]
@@ -165,20 +391,103 @@ func (cs *Store) watchAddrUpdates() error {
 		}
 	}
 
-	// targetToAddrs 有 targetToClient 无，则增加
-	for target, _ := range cs.targetToAddrs {
+	// targetToAddrs 有 targetToClient 无，则增加，lazy 模式下只增加已被使用的
+	for target := range cs.targetToAddrs {
 		_, ok := cs.targetToClient[target]
-		if !ok {
-			r := &etcdnaming.GRPCResolver{Client: cs.etcdCli}
-			opt := grpc.WithBalancer(grpc.RoundRobin(r))
+		if !ok && (!cs.opts.lazy || cs.wanted[target]) {
+			cs.newClient(target)
+		}
+	}
+
+	return len(changed) > 0
+}
 
-			cs.targetToClient[target] = newClient(context.Background(), cs.logger, target,
-				func() (interface{}, io.Closer, error) {
-					return cs.dial(target, opt)
-				},
-			)
+// newClient 须持有 cs.mu
+func (cs *Store) newClient(target string) *client {
+	dialTarget := cs.r.dialTarget(target)
+	u := newUsage()
+	dropped := func() {
+		cs.droppedOnce.Do(func() {
+			cs.logger.Warnf("Calls to %q bypass the interceptors of the Store, the DialFunc should add its own with AppendUnaryInterceptors and AppendStreamInterceptors", target)
+		})
+	}
+	opts := append([]grpc.DialOption{grpc.WithBalancerName(cs.opts.balancerName)}, cs.opts.dialOptions(u, dropped)...)
+
+	client := newClient(cs.ctx, cs.logger, cs.opts, target, u,
+		func() (interface{}, io.Closer, error) {
+			return cs.dial(dialTarget, opts...)
+		},
+		cs.notify,
+		func() {
+			cs.publish(&Event{Type: ClientConnected, Target: target, Addrs: addrsOf(cs.r.addrs(target))})
+		},
+	)
+	cs.targetToClient[target] = client
+	return client
+}
+
+// useClient 获取 target 的客户端并记录使用时间
+// lazy 模式下首次使用时才创建客户端，若尚未发现 target 则在发现后创建
+func (cs *Store) useClient(target string) (*client, bool) {
+	cs.mu.RLock()
+	client, ok := cs.targetToClient[target]
+	cs.mu.RUnlock()
+
+	if ok || !cs.opts.lazy {
+		if ok {
+			client.touch()
 		}
+		return client, ok
 	}
 
-	return nil
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.stopped || !cs.opts.allowed(target) {
+		return nil, false
+	}
+
+	cs.wanted[target] = true
+	if client, ok = cs.targetToClient[target]; ok {
+		client.touch()
+		return client, true
+	}
+	if _, ok = cs.targetToAddrs[target]; !ok {
+		return nil, false
+	}
+	return cs.newClient(target), true
+}
+
+// closeIdleClients 关闭 lazy 模式下空闲超时的客户端
+func (cs *Store) closeIdleClients() {
+	t := time.NewTicker(cs.opts.idleTimeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-cs.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		cs.mu.Lock()
+		for target, client := range cs.targetToClient {
+			if client.idle() < cs.opts.idleTimeout {
+				continue
+			}
+			delete(cs.targetToClient, target)
+			delete(cs.wanted, target)
+			client.close()
+			cs.logger.Infof("Closed idle client of %q", target)
+		}
+		cs.mu.Unlock()
+		cs.notify()
+	}
+}
+
+func addrsOf(addrs []resolver.Address) []string {
+	ss := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ss = append(ss, addr.Addr)
+	}
+	return ss
 }
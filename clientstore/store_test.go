@@ -0,0 +1,553 @@
+package clientstore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/registry"
+	"github.com/molon/pkg/registry/registrytest"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func startHealthServer(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(l)
+	return l.Addr().String(), s.Stop
+}
+
+func healthDial(target string, opts ...grpc.DialOption) (interface{}, io.Closer, error) {
+	cc, err := grpc.Dial(target, append(opts, grpc.WithInsecure())...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return healthpb.NewHealthClient(cc), cc, nil
+}
+
+func TestStoreWithStaticWatcher(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	w := NewStaticWatcher(map[string][]Endpoint{
+		"test://health": {{Addr: addr}},
+	})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, healthDial)
+	cs.Start()
+	defer cs.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cli, err := cs.WaitFor(ctx, "test://health", WithReady())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := cli.(healthpb.HealthClient).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+}
+
+func TestStoreWaitForTimeout(t *testing.T) {
+	w := NewStaticWatcher(nil)
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, healthDial)
+	cs.Start()
+	defer cs.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cs.WaitFor(ctx, "test://missing")
+	if _, ok := err.(*WaitError); !ok || errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestStoreSubscribe(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	w := NewStaticWatcher(map[string][]Endpoint{
+		"test://health": {{Addr: addr}},
+	})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, healthDial)
+	eventC, cancel := cs.Subscribe()
+	defer cancel()
+	cs.Start()
+	defer cs.Stop()
+
+	want := []EventType{TargetAdded, AddressAdded, ClientConnected}
+	for _, typ := range want {
+		select {
+		case e := <-eventC:
+			if e.Type != typ || e.Target != "test://health" || len(e.Addrs) != 1 || e.Addrs[0] != addr {
+				t.Fatalf("unexpected event %v %+v, want %v", e.Type, e, typ)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for %v", typ)
+		}
+	}
+}
+
+func TestStoreRedialUnhealthy(t *testing.T) {
+	addr, stop := startHealthServer(t)
+
+	dialed := make(chan struct{}, 10)
+	dial := func(target string, opts ...grpc.DialOption) (interface{}, io.Closer, error) {
+		dialed <- struct{}{}
+		return healthDial(target, opts...)
+	}
+
+	w := NewStaticWatcher(map[string][]Endpoint{
+		"test://health": {{Addr: addr}},
+	})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, dial,
+		WithUnhealthyTimeout(100*time.Millisecond),
+		WithBackoff(Backoff{BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}),
+	)
+	cs.Start()
+	defer cs.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := cs.WaitFor(ctx, "test://health", WithReady()); err != nil {
+		t.Fatal(err)
+	}
+	<-dialed
+
+	stop()
+	select {
+	case <-dialed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("unhealthy client not redialed")
+	}
+}
+
+func TestStoreWithEtcdFailover(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	r := registry.NewRegister(etcd.NewClient(), "test://health", addr, 10, registry.WithVersion("v1"))
+	defer r.Close()
+
+	cs := NewStore(logrus.StandardLogger(), etcd.NewClient(), "test://", healthDial)
+	eventC, cancel := cs.Subscribe()
+	defer cancel()
+	cs.Start()
+	defer cs.Stop()
+
+	ctx, cancelWait := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancelWait()
+	if _, err := cs.WaitFor(ctx, "test://health", WithReady()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitEvent := func(typ EventType) {
+		t.Helper()
+		for {
+			select {
+			case e := <-eventC:
+				if e.Type == typ && e.Target == "test://health" {
+					return
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timeout waiting for %v", typ)
+			}
+		}
+	}
+	waitEvent(AddressAdded)
+
+	// lease 过期后地址被移除，重新注册后再次加入
+	etcd.ExpireLease(r.State().Lease)
+	waitEvent(AddressRemoved)
+	waitEvent(AddressAdded)
+	if _, err := cs.WaitFor(ctx, "test://health", WithReady()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type failingWatcher struct{ closeC chan struct{} }
+
+func (w *failingWatcher) Next() ([]*Update, error) {
+	select {
+	case <-w.closeC:
+		return nil, ErrWatcherClosed
+	case <-time.After(10 * time.Millisecond):
+		return nil, errors.New("discovery unavailable")
+	}
+}
+
+func (w *failingWatcher) Close() { close(w.closeC) }
+
+func TestStoreCacheFile(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "clientstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache.json")
+
+	w := NewStaticWatcher(map[string][]Endpoint{
+		"test://health": {{Addr: addr}},
+	})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, healthDial, WithCacheFile(cacheFile))
+	cs.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := cs.WaitFor(ctx, "test://health"); err != nil {
+		t.Fatal(err)
+	}
+	cs.Stop()
+
+	cs = NewStoreWithWatcher(logrus.StandardLogger(), &failingWatcher{closeC: make(chan struct{})}, healthDial, WithCacheFile(cacheFile))
+	cs.Start()
+	defer cs.Stop()
+	if !cs.IsStale() {
+		t.Fatal("expected stale store")
+	}
+	if _, err := cs.WaitFor(ctx, "test://health", WithReady()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreLazy(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	dialed := make(chan struct{}, 10)
+	dial := func(target string, opts ...grpc.DialOption) (interface{}, io.Closer, error) {
+		dialed <- struct{}{}
+		return healthDial(target, opts...)
+	}
+
+	w := NewStaticWatcher(map[string][]Endpoint{
+		"test://health": {{Addr: addr}},
+		"test://other":  {{Addr: addr}},
+	})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, dial,
+		WithLazy(100*time.Millisecond),
+		WithTargets("test://health"),
+	)
+	cs.Start()
+	defer cs.Stop()
+
+	select {
+	case <-dialed:
+		t.Fatal("dialed before use")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := cs.WaitFor(ctx, "test://health"); err != nil {
+		t.Fatal(err)
+	}
+	<-dialed
+
+	if _, ok := cs.Get("test://other"); ok {
+		t.Fatal("filtered target should not be dialed")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	cs.mu.RLock()
+	n := len(cs.targetToClient)
+	cs.mu.RUnlock()
+	if n != 0 {
+		t.Fatal("idle client not closed")
+	}
+}
+
+func TestStoreLazyInUse(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	var dials int32
+	dial := func(target string, opts ...grpc.DialOption) (interface{}, io.Closer, error) {
+		atomic.AddInt32(&dials, 1)
+		return healthDial(target, opts...)
+	}
+	w := NewStaticWatcher(map[string][]Endpoint{"test://health": {{Addr: addr}}})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, dial, WithLazy(100*time.Millisecond))
+	cs.Start()
+	defer cs.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cli, err := cs.WaitFor(ctx, "test://health", WithReady())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := cli.(healthpb.HealthClient)
+	clients := func() int {
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		return len(cs.targetToClient)
+	}
+
+	// 只 Get 一次并保留客户端，之后的调用也算作使用
+	for deadline := time.Now().Add(400 * time.Millisecond); time.Now().Before(deadline); {
+		if _, err := hc.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if clients() != 1 {
+		t.Fatal("client in use closed")
+	}
+
+	// 未结束的 stream 也算作使用
+	sctx, scancel := context.WithCancel(ctx)
+	stream, err := hc.Watch(sctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if clients() != 1 {
+		t.Fatal("client with an open stream closed")
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("dialed %d times", n)
+	}
+
+	scancel()
+	time.Sleep(400 * time.Millisecond)
+	if clients() != 0 {
+		t.Fatal("idle client not closed")
+	}
+}
+
+func TestStoreDebugHandler(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	w := NewStaticWatcher(map[string][]Endpoint{
+		"test://health": {{Addr: addr, Metadata: map[string]interface{}{"weight": 2, "zone": "z1"}}},
+	})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, healthDial)
+	cs.Start()
+	defer cs.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := cs.WaitFor(ctx, "test://health", WithReady()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	cs.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+	var state debugState
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Targets) != 1 || len(state.Targets[0].Addrs) != 1 {
+		t.Fatalf("unexpected state %s", rec.Body.String())
+	}
+	target := state.Targets[0]
+	if target.Addrs[0].Metadata.Weight != 2 || target.Addrs[0].Metadata.Zone != "z1" {
+		t.Fatalf("unexpected metadata %+v", target.Addrs[0].Metadata)
+	}
+	if target.Client == nil || target.Client.State != "READY" {
+		t.Fatalf("unexpected client %+v", target.Client)
+	}
+
+	rec = httptest.NewRecorder()
+	cs.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(rec.Body.String(), addr) {
+		t.Fatalf("address missing from page %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	cs.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d of HEAD", rec.Code)
+	}
+}
+
+func TestStoreInterceptors(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	var order []string
+	interceptor := func(name string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			order = append(order, name)
+			return invoker(ctx, method, req, resp, cc, opts...)
+		}
+	}
+
+	w := NewStaticWatcher(map[string][]Endpoint{
+		"test://health": {{Addr: addr}},
+	})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, healthDial,
+		WithDefaultInterceptors(DefaultInterceptorConfig),
+		WithUnaryInterceptors(interceptor("a"), interceptor("b")),
+	)
+	cs.Start()
+	defer cs.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cli, err := cs.WaitFor(ctx, "test://health", WithReady())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.(healthpb.HealthClient).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "a" || order[1] != "b" {
+		t.Fatalf("unexpected interceptor order %v", order)
+	}
+}
+
+func TestStoreDialFuncInterceptors(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	var order []string
+	interceptor := func(name string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			order = append(order, name)
+			return invoker(ctx, method, req, resp, cc, opts...)
+		}
+	}
+	// DialFunc 自己的拦截器与 Store 的拦截器串联，不会覆盖
+	dial := func(target string, opts ...grpc.DialOption) (interface{}, io.Closer, error) {
+		return healthDial(target, AppendUnaryInterceptors(opts, interceptor("dial"))...)
+	}
+
+	w := NewStaticWatcher(map[string][]Endpoint{
+		"test://health": {{Addr: addr}},
+	})
+	cs := NewStoreWithWatcher(logrus.StandardLogger(), w, dial,
+		WithUnaryInterceptors(interceptor("store")),
+		WithOutlierDetection(OutlierConfig{}),
+	)
+	cs.Start()
+	defer cs.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cli, err := cs.WaitFor(ctx, "test://health", WithReady())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.(healthpb.HealthClient).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "store" || order[1] != "dial" {
+		t.Fatalf("unexpected interceptor order %v", order)
+	}
+	if states := cs.OutlierStates("test://health"); len(states) != 1 || states[0].Requests != 1 {
+		t.Fatalf("call not recorded by the outlier detection: %+v", states)
+	}
+}
+
+// warnHook 记录 Warn 级别的日志
+type warnHook struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (*warnHook) Levels() []logrus.Level { return []logrus.Level{logrus.WarnLevel} }
+
+func (h *warnHook) Fire(e *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.msgs = append(h.msgs, e.Message)
+	return nil
+}
+
+func (h *warnHook) count(substr string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, msg := range h.msgs {
+		if strings.Contains(msg, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStoreDialFuncOverridesInterceptors(t *testing.T) {
+	addr, stop := startHealthServer(t)
+	defer stop()
+
+	interceptor := func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(ctx, method, req, resp, cc, opts...)
+	}
+	for _, tc := range []struct {
+		name  string
+		opts  func(opts []grpc.DialOption) []grpc.DialOption
+		warns int
+	}{
+		{"append", func(opts []grpc.DialOption) []grpc.DialOption {
+			return AppendUnaryInterceptors(opts, interceptor)
+		}, 0},
+		// 直接使用 grpc.WithUnaryInterceptor 会覆盖 Store 的拦截器
+		{"override", func(opts []grpc.DialOption) []grpc.DialOption {
+			return append(opts, grpc.WithUnaryInterceptor(interceptor))
+		}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dial := func(target string, opts ...grpc.DialOption) (interface{}, io.Closer, error) {
+				return healthDial(target, tc.opts(opts)...)
+			}
+			logger := logrus.New()
+			hook := &warnHook{}
+			logger.AddHook(hook)
+
+			w := NewStaticWatcher(map[string][]Endpoint{
+				"test://health": {{Addr: addr}},
+			})
+			cs := NewStoreWithWatcher(logger, w, dial)
+			cs.Start()
+			defer cs.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			cli, err := cs.WaitFor(ctx, "test://health", WithReady())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := cli.(healthpb.HealthClient).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := hook.count("bypass the interceptors of the Store"); n != tc.warns {
+				t.Fatalf("warned %d times, want %d", n, tc.warns)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package clientstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/wait"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrTargetRemoved = status.Errorf(codes.Unavailable, "clientstore: target removed")
+	ErrStoreStopped  = status.Errorf(codes.Unavailable, "clientstore: store stopped")
+)
+
+// WaitError is returned by Store.WaitFor. Err is ctx.Err(), ErrTargetRemoved or
+// ErrStoreStopped, and errors.Cause returns it.
+type WaitError struct {
+	Target string
+	Err    error
+}
+
+func (e *WaitError) Error() string { return fmt.Sprintf("wait for %q: %v", e.Target, e.Err) }
+
+func (e *WaitError) Cause() error { return e.Err }
+
+type waitOptions struct {
+	ready bool
+}
+
+type WaitOption func(*waitOptions)
+
+// WithReady makes WaitFor also wait for the underlying grpc.ClientConn to
+// reach READY. It has no effect if the io.Closer returned by DialFunc is not
+// a *grpc.ClientConn.
+func WithReady() WaitOption {
+	return func(options *waitOptions) {
+		options.ready = true
+	}
+}
+
+// WaitFor blocks until the client for target has been dialed, returning a
+// *WaitError if ctx is done, the store is stopped, or the target disappears
+// from discovery after it has been seen.
+func (cs *Store) WaitFor(ctx context.Context, target string, options ...WaitOption) (interface{}, error) {
+	opts := &waitOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+
+	var cli interface{}
+	var seen bool
+	err := cs.waiter.Wait(ctx, func(ctx context.Context) error {
+		client, ok := cs.useClient(target)
+		if !ok {
+			if seen {
+				return errors.WithStack(ErrTargetRemoved)
+			}
+			return wait.ErrorWaiterContinue
+		}
+		seen = true
+
+		cli = client.cli()
+		if cli == nil || (opts.ready && !client.isReady()) {
+			return wait.ErrorWaiterContinue
+		}
+		return nil
+	})
+	if err != nil {
+		cause := errors.Cause(err)
+		if cause == wait.ErrorWaiterClosed {
+			cause = ErrStoreStopped
+		}
+		return nil, &WaitError{Target: target, Err: cause}
+	}
+	return cli, nil
+}
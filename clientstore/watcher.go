@@ -3,12 +3,13 @@ package clientstore
 import (
 	"context"
 	"encoding/json"
+	"reflect"
 
 	etcd "github.com/coreos/etcd/clientv3"
 	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/etcdsync"
 
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/naming"
 	"google.golang.org/grpc/status"
 
 	"github.com/coreos/etcd/mvcc/mvccpb"
@@ -16,83 +17,97 @@ import (
 
 var ErrWatcherClosed = status.Errorf(codes.Unavailable, "naming: watch closed")
 
+// Operation defines the corresponding operations for a name resolution change.
+// The values are the same as the deprecated grpc/naming.Operation, which is
+// still what the registered json values carry.
+type Operation uint8
+
+const (
+	// Add indicates a new address is added.
+	Add Operation = iota
+	// Delete indicates an existing address is deleted.
+	Delete
+)
+
 type Update struct {
-	Op       naming.Operation
+	Op       Operation
 	Addr     string
 	Target   string
 	Metadata interface{}
 }
 
+// Watcher watches for the updates on the targets under discovery.
+// Store consumes it, so any discovery backend can drive the same Store logic.
+type Watcher interface {
+	// Next blocks until an update or error happens. It may return one or more
+	// updates. The first call should get the full set of the results.
+	// After Close it returns ErrWatcherClosed. Other errors are transient, the
+	// caller may call Next again later and the Watcher should catch up.
+	Next() ([]*Update, error)
+	// Close closes the Watcher.
+	Close()
+}
+
+var _ Watcher = (*GRPCWatcher)(nil)
+
 func NewGRPCWatcher(c *etcd.Client, targetPrefix string) *GRPCWatcher {
 	ctx, cancel := context.WithCancel(context.Background())
-	w := &GRPCWatcher{c: c, targetPrefix: targetPrefix, ctx: ctx, cancel: cancel}
+	w := &GRPCWatcher{
+		ctx:    ctx,
+		cancel: cancel,
+		s:      etcdsync.NewSyncer(ctx, c, targetPrefix, etcdsync.WithPrefix(), etcdsync.WithSerializable()),
+	}
 	return w
 }
 
+// GRPCWatcher watches the addresses registered in etcd under targetPrefix.
+// If the watch fails, e.g. the revision has been compacted, it fetches the
+// full set again, diffs it against the known addresses to synthesize the
+// missed updates, and watches again from the new revision.
 type GRPCWatcher struct {
-	c            *etcd.Client
-	targetPrefix string
-	ctx          context.Context
-	cancel       context.CancelFunc
-	wch          etcd.WatchChan
-	err          error
+	ctx    context.Context
+	cancel context.CancelFunc
+	s      *etcdsync.Syncer
 }
 
-func (gw *GRPCWatcher) Next() ([]*Update, error) {
-	if gw.wch == nil {
-		return gw.firstNext()
-	}
-	if gw.err != nil {
-		return nil, gw.err
-	}
+// Revision returns the etcd revision the Watcher has caught up with,
+// 0 before the first sync.
+func (gw *GRPCWatcher) Revision() int64 { return gw.s.Revision() }
 
-	wr, ok := <-gw.wch
-	if !ok {
-		gw.err = errors.WithStack(ErrWatcherClosed)
-		return nil, gw.err
+func (gw *GRPCWatcher) Next() ([]*Update, error) {
+	events, err := gw.s.Next(gw.ctx)
+	if gw.ctx.Err() != nil {
+		return nil, errors.WithStack(ErrWatcherClosed)
 	}
-	if gw.err = wr.Err(); gw.err != nil {
-		return nil, gw.err
+	if err != nil {
+		return nil, err
 	}
 
-	updates := make([]*Update, 0, len(wr.Events))
-	for _, e := range wr.Events {
+	updates := make([]*Update, 0, len(events))
+	for _, e := range events {
 		var jupdate *Update
 		var err error
 		switch e.Type {
 		case etcd.EventTypePut:
 			jupdate, err = unmarshalToUpdate(e.Kv)
-			jupdate.Op = naming.Add
+			if err != nil {
+				continue
+			}
+			jupdate.Op = Add
 		case etcd.EventTypeDelete:
+			if e.PrevKv == nil {
+				continue
+			}
 			jupdate, err = unmarshalToUpdate(e.PrevKv)
-			jupdate.Op = naming.Delete
-		}
-		if err == nil {
-			updates = append(updates, jupdate)
-		}
-	}
-	return updates, nil
-}
-
-func (gw *GRPCWatcher) firstNext() ([]*Update, error) {
-	resp, err := gw.c.Get(gw.ctx, gw.targetPrefix, etcd.WithPrefix(), etcd.WithSerializable())
-	if gw.err = err; err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	updates := make([]*Update, 0, len(resp.Kvs))
-	for _, kv := range resp.Kvs {
-		jupdate, err := unmarshalToUpdate(kv)
-		if err != nil {
+			if err != nil {
+				continue
+			}
+			jupdate.Op = Delete
+		default:
 			continue
 		}
-		jupdate.Op = naming.Add
-
 		updates = append(updates, jupdate)
 	}
-
-	opts := []etcd.OpOption{etcd.WithRev(resp.Header.Revision + 1), etcd.WithPrefix(), etcd.WithPrevKV()}
-	gw.wch = gw.c.Watch(gw.ctx, gw.targetPrefix, opts...)
 	return updates, nil
 }
 
@@ -109,3 +124,23 @@ func unmarshalToUpdate(kv *mvccpb.KeyValue) (*Update, error) {
 	jupdate.Target = key[:len(key)-len(jupdate.Addr)-1]
 	return &jupdate, nil
 }
+
+func updateKey(target, addr string) string { return target + "/" + addr }
+
+// diffUpdates 对比新旧两份全量记录，生成 Add/Delete 的增量更新
+// 地址不变但 Metadata 变化的，也作为 Add 下发
+func diffUpdates(old, cur map[string]*Update) []*Update {
+	var updates []*Update
+	for key, u := range old {
+		if _, ok := cur[key]; !ok {
+			updates = append(updates, &Update{Op: Delete, Addr: u.Addr, Target: u.Target, Metadata: u.Metadata})
+		}
+	}
+	for key, u := range cur {
+		if ou, ok := old[key]; ok && reflect.DeepEqual(ou.Metadata, u.Metadata) {
+			continue
+		}
+		updates = append(updates, &Update{Op: Add, Addr: u.Addr, Target: u.Target, Metadata: u.Metadata})
+	}
+	return updates
+}
@@ -0,0 +1,149 @@
+package clientstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/registry/registrytest"
+)
+
+func TestFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "targets.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+msg://boat:
+  - addr: 127.0.0.1:1000
+  - addr: 127.0.0.1:1001
+    metadata:
+      weight: 10
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fw := NewFileWatcher(path, 10*time.Millisecond)
+	defer fw.Close()
+
+	updates, err := fw.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("expected 2 updates, got %d", len(updates))
+	}
+
+	// 修改时间精度可能不足，大小变化也会触发重新加载
+	if err := ioutil.WriteFile(path, []byte(`
+msg://boat:
+  - addr: 127.0.0.1:1001
+    metadata:
+      weight: 20
+  - addr: 127.0.0.1:1002
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	updates, err = fw.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, u := range updates {
+		op := "add"
+		if u.Op == Delete {
+			op = "delete"
+		}
+		got = append(got, op+" "+u.Addr)
+	}
+	sort.Strings(got)
+	want := []string{"add 127.0.0.1:1001", "add 127.0.0.1:1002", "delete 127.0.0.1:1000"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestFileWatcherClosed(t *testing.T) {
+	fw := NewFileWatcher(filepath.Join(os.TempDir(), "clientstore-missing.yaml"), 10*time.Millisecond)
+	fw.Close()
+	if _, err := fw.Next(); errors.Cause(err) != ErrWatcherClosed {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestGRPCWatcherResync(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c, writer := etcd.NewClient(), etcd.NewClient()
+	ctx := context.Background()
+
+	put := func(addr, md string) {
+		t.Helper()
+		if _, err := writer.Put(ctx, "test://svc/"+addr, `{"Op":0,"Addr":"`+addr+`","Metadata":`+md+`}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("127.0.0.1:1", `{"weight":1}`)
+	put("127.0.0.1:2", `{"weight":1}`)
+
+	gw := NewGRPCWatcher(c, "test://")
+	defer gw.Close()
+	updates, err := gw.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("expected 2 updates, got %d", len(updates))
+	}
+
+	// 分区期间的变化被压缩，恢复后 watch 失败，重新同步并生成错过的更新
+	etcd.Partition(c)
+	if _, err := writer.Delete(ctx, "test://svc/127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	// 重复的写入在重新同步后只生成一次更新
+	put("127.0.0.1:2", `{"weight":2}`)
+	put("127.0.0.1:2", `{"weight":2}`)
+	put("127.0.0.1:3", `{"weight":1}`)
+	if _, err := writer.Compact(ctx, etcd.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	etcd.Heal(c)
+
+	updates, err = gw.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, u := range updates {
+		op := "add"
+		if u.Op == Delete {
+			op = "delete"
+		}
+		got = append(got, op+" "+u.Target+"/"+u.Addr)
+	}
+	sort.Strings(got)
+	want := []string{"add test://svc/127.0.0.1:2", "add test://svc/127.0.0.1:3", "delete test://svc/127.0.0.1:1"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if gw.Revision() != etcd.Revision() {
+		t.Fatalf("revision %d, want %d", gw.Revision(), etcd.Revision())
+	}
+}
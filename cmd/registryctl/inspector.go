@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/molon/pkg/clientstore"
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/etcdsync"
+	"github.com/molon/pkg/putil"
+)
+
+var errUsage = errors.New("usage")
+
+// instance 是一个已注册的地址，TTL 为 lease 的剩余秒数，lease 不存在时为 -1，获取失败时为0
+type instance struct {
+	Target   string                `json:"target"`
+	Addr     string                `json:"addr"`
+	Metadata *clientstore.Metadata `json:"metadata"`
+	Lease    string                `json:"lease,omitempty"`
+	TTL      int64                 `json:"ttl"`
+
+	key     string
+	leaseID v3.LeaseID
+	// 获取 TTL 失败，表格中不显示为0s
+	ttlUnknown bool
+}
+
+type inspector struct {
+	c       *v3.Client
+	w       io.Writer
+	errW    io.Writer
+	json    bool
+	timeout time.Duration
+	// watch 重新同步失败后的重试间隔
+	resyncDelay time.Duration
+}
+
+func (in *inspector) list(ctx context.Context, prefix string) error {
+	insts, err := in.get(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if in.json {
+		for _, inst := range insts {
+			in.printJSON("", inst)
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(in.w, 0, 4, 2, ' ', 0)
+	printf(tw, "TARGET\tADDR\tWEIGHT\tVERSION\tZONE\tPROTOCOL\tTAGS\tDRAINING\tLEASE\tTTL\n")
+	for _, inst := range insts {
+		md := inst.Metadata
+		printf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%v\t%s\t%s\n",
+			inst.Target, inst.Addr, md.Weight, md.Version, md.Zone, md.Protocol,
+			formatTags(md.Tags), md.Draining, inst.Lease, formatTTL(inst))
+	}
+	return tw.Flush()
+}
+
+// watch 打印全量后持续打印变化；watch 失败(例如版本被压缩)时重新获取全量，并打印与之前的差异
+// 诊断信息写到 errW，以免混入 --json 的输出
+func (in *inspector) watch(ctx context.Context, prefix string) error {
+	s := etcdsync.NewSyncer(ctx, in.c, prefix, etcdsync.WithPrefix(), etcdsync.WithWatchErrorHandler(func(err error) {
+		printf(in.errW, "# watch failed, resyncing: %v\n", err)
+	}))
+	defer s.Close()
+
+	// 首次获取失败直接返回
+	gctx, cancel := context.WithTimeout(ctx, in.timeout)
+	events, err := s.Next(gctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	for {
+		in.printEvents(ctx, events)
+
+		for {
+			events, err = s.Next(ctx)
+			if ctx.Err() != nil {
+				return errors.WithStack(ctx.Err())
+			}
+			if err == nil {
+				break
+			}
+			printf(in.errW, "# resync failed: %v\n", err)
+			if err := putil.Sleep(ctx, in.resyncDelay); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (in *inspector) printEvents(ctx context.Context, events []*v3.Event) {
+	ctx, cancel := context.WithTimeout(ctx, in.timeout)
+	defer cancel()
+
+	for _, ev := range events {
+		switch ev.Type {
+		case mvccpb.PUT:
+			inst, err := parseInstance(ev.Kv)
+			if err != nil {
+				printf(in.errW, "# skip %q: %v\n", ev.Kv.Key, err)
+				continue
+			}
+			in.fillTTL(ctx, []*instance{inst})
+			in.printEvent("PUT", inst)
+		case mvccpb.DELETE:
+			// 与注册无关的 key 在 PUT 时已跳过
+			inst, err := parseInstance(ev.PrevKv)
+			if err != nil {
+				continue
+			}
+			in.printEvent("DELETE", inst)
+		}
+	}
+}
+
+// deregister 撤销实例的 lease，绑定到该 lease 的 key 都会被删除
+func (in *inspector) deregister(ctx context.Context, target, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, in.timeout)
+	defer cancel()
+
+	key := target + "/" + addr
+	resp, err := in.c.Get(ctx, key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return errors.Errorf("%q is not registered", key)
+	}
+
+	kv := resp.Kvs[0]
+	if kv.Lease == 0 {
+		// 没有 lease 的 key 只能直接删除，期间被重新写入则不删除
+		cmp := v3.Compare(v3.ModRevision(key), "=", kv.ModRevision)
+		tresp, err := in.c.Txn(ctx).If(cmp).Then(v3.OpDelete(key)).Commit()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !tresp.Succeeded {
+			return errors.Errorf("%q changed, try again", key)
+		}
+		printf(in.w, "Deleted %s, which has no lease\n", key)
+		return nil
+	}
+
+	leaseID := v3.LeaseID(kv.Lease)
+	ttl, err := in.c.TimeToLive(ctx, leaseID, v3.WithAttachedKeys())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := in.c.Revoke(ctx, leaseID); err != nil {
+		return errors.Wrapf(err, "revoke lease %x", kv.Lease)
+	}
+	printf(in.w, "Revoked lease %x of %s, deleted keys:\n", kv.Lease, key)
+	for _, k := range ttl.Keys {
+		printf(in.w, "  %s\n", k)
+	}
+	return nil
+}
+
+// get 获取 prefix 下的全部实例及其 lease 剩余时间
+func (in *inspector) get(ctx context.Context, prefix string) ([]*instance, error) {
+	ctx, cancel := context.WithTimeout(ctx, in.timeout)
+	defer cancel()
+
+	resp, err := in.c.Get(ctx, prefix, v3.WithPrefix())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	insts := make([]*instance, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		inst, err := parseInstance(kv)
+		if err != nil {
+			// 与注册无关的 key，例如 Register.Put 写入的
+			continue
+		}
+		insts = append(insts, inst)
+	}
+	in.fillTTL(ctx, insts)
+	return insts, nil
+}
+
+// fillTTL 获取失败时 TTL 保持为0，并标记为未知
+func (in *inspector) fillTTL(ctx context.Context, insts []*instance) {
+	ttls := make(map[v3.LeaseID]int64)
+	for _, inst := range insts {
+		if inst.leaseID == v3.NoLease {
+			continue
+		}
+		ttl, ok := ttls[inst.leaseID]
+		if !ok {
+			resp, err := in.c.TimeToLive(ctx, inst.leaseID)
+			if err != nil {
+				inst.ttlUnknown = true
+				continue
+			}
+			ttl = resp.TTL
+			ttls[inst.leaseID] = ttl
+		}
+		inst.TTL = ttl
+	}
+}
+
+func parseInstance(kv *mvccpb.KeyValue) (*instance, error) {
+	var u clientstore.Update
+	if err := json.Unmarshal(kv.Value, &u); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	key := string(kv.Key)
+	if u.Addr == "" || !strings.HasSuffix(key, "/"+u.Addr) {
+		return nil, errors.New("not a registered address")
+	}
+	inst := &instance{
+		Target:   key[:len(key)-len(u.Addr)-1],
+		Addr:     u.Addr,
+		Metadata: clientstore.ParseMetadata(u.Metadata),
+		key:      key,
+		leaseID:  v3.LeaseID(kv.Lease),
+	}
+	if kv.Lease != 0 {
+		inst.Lease = fmt.Sprintf("%x", kv.Lease)
+	}
+	return inst, nil
+}
+
+func (in *inspector) printEvent(typ string, inst *instance) {
+	if in.json {
+		in.printJSON(typ, inst)
+		return
+	}
+	md := inst.Metadata
+	s := fmt.Sprintf("%s %s %s %s weight=%d", time.Now().Format("15:04:05"), typ, inst.Target, inst.Addr, md.Weight)
+	if typ == "PUT" {
+		for _, f := range [][2]string{{"version", md.Version}, {"zone", md.Zone}, {"protocol", md.Protocol}, {"tags", formatTags(md.Tags)}} {
+			if f[1] != "" {
+				s += fmt.Sprintf(" %s=%s", f[0], f[1])
+			}
+		}
+		if md.Draining {
+			s += " draining"
+		}
+		if inst.Lease != "" {
+			s += fmt.Sprintf(" lease=%s ttl=%s", inst.Lease, formatTTL(inst))
+		}
+	}
+	printf(in.w, "%s\n", s)
+}
+
+func (in *inspector) printJSON(typ string, inst *instance) {
+	v := interface{}(inst)
+	if typ != "" {
+		v = struct {
+			Event string `json:"event"`
+			*instance
+		}{typ, inst}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		printf(in.errW, "# marshal %q: %v\n", inst.key, err)
+		return
+	}
+	printf(in.w, "%s\n", data)
+}
+
+func formatTags(tags map[string]string) string {
+	kvs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func formatTTL(inst *instance) string {
+	switch {
+	case inst.leaseID == v3.NoLease:
+		return "-"
+	case inst.ttlUnknown:
+		return "unknown"
+	case inst.TTL < 0:
+		return "expired"
+	default:
+		return (time.Duration(inst.TTL) * time.Second).String()
+	}
+}
@@ -0,0 +1,122 @@
+// Command registryctl inspects the instances published by registry.Register.
+//
+//	registryctl [flags] list [prefix]
+//	registryctl [flags] watch [prefix]
+//	registryctl [flags] deregister <target> <addr>
+//
+// list prints the instances under prefix with their metadata and the
+// remaining TTL of their leases, watch prints them and then every change
+// until interrupted, and deregister revokes the lease of an instance, which
+// deletes all the keys bound to it. A live Register re-registers with a new
+// lease after that, so deregister is meant for the stale instances.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+)
+
+const usage = `Usage: registryctl [flags] <command> [args]
+
+Commands:
+  list [prefix]               list the instances under prefix
+  watch [prefix]              list the instances, then print every change
+  deregister <target> <addr>  revoke the lease of the instance
+
+Flags:
+`
+
+func main() {
+	fs := flag.NewFlagSet("registryctl", flag.ExitOnError)
+	endpoints := fs.String("endpoints", "127.0.0.1:2379", "comma separated etcd endpoints")
+	dialTimeout := fs.Duration("dial-timeout", 5*time.Second, "timeout of connecting to etcd")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each request, except watch")
+	resyncDelay := fs.Duration("resync-delay", time.Second, "delay between the retries of resyncing a failed watch")
+	jsonOut := fs.Bool("json", false, "print instances as JSON lines")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	args := fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := v3.New(v3.Config{
+		Endpoints:   strings.Split(*endpoints, ","),
+		DialTimeout: *dialTimeout,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect etcd: %v\n", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigC := make(chan os.Signal, 1)
+		signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+		<-sigC
+		cancel()
+	}()
+
+	in := &inspector{c: c, w: os.Stdout, errW: os.Stderr, json: *jsonOut, timeout: *timeout, resyncDelay: *resyncDelay}
+	if err := run(ctx, in, args); err != nil {
+		if err == errUsage {
+			fs.Usage()
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, in *inspector, args []string) error {
+	prefix := func() string {
+		if len(args) > 1 {
+			return args[1]
+		}
+		return ""
+	}
+	switch args[0] {
+	case "list", "ls":
+		if len(args) > 2 {
+			return errUsage
+		}
+		return in.list(ctx, prefix())
+	case "watch":
+		if len(args) > 2 {
+			return errUsage
+		}
+		err := in.watch(ctx, prefix())
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	case "deregister":
+		if len(args) != 3 {
+			return errUsage
+		}
+		return in.deregister(ctx, args[1], args[2])
+	default:
+		return errUsage
+	}
+}
+
+// printf 忽略写入错误，与 fmt.Printf 的常见用法一致
+func printf(w io.Writer, format string, args ...interface{}) {
+	fmt.Fprintf(w, format, args...)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/molon/pkg/registry"
+	"github.com/molon/pkg/registry/registrytest"
+)
+
+// syncBuffer 供 watch 的 goroutine 写入，测试读取
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitRegistered(t *testing.T, r *registry.Register) registry.RegisterStatus {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for r.State().State != registry.Registered {
+		if time.Now().After(deadline) {
+			t.Fatalf("not registered: %v", r.State().State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return r.State()
+}
+
+func TestListAndDeregister(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx := context.Background()
+
+	r := registry.NewRegister(etcd.NewClient(), "msg://boat", "127.0.0.1:8080", 30,
+		registry.WithVersion("v2"), registry.WithTag("canary", "true"))
+	defer r.Close()
+	st := waitRegistered(t, r)
+
+	var buf bytes.Buffer
+	in := &inspector{c: c, w: &buf, errW: &buf, timeout: time.Second, resyncDelay: 10 * time.Millisecond}
+	if err := run(ctx, in, []string{"list", "msg://"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	for _, want := range []string{"msg://boat", "127.0.0.1:8080", "v2", "canary=true", "30s"} {
+		if !strings.Contains(lines[1], want) {
+			t.Fatalf("%q not in %q", want, lines[1])
+		}
+	}
+
+	buf.Reset()
+	in.json = true
+	if err := run(ctx, in, []string{"list"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"target":"msg://boat"`) {
+		t.Fatalf("unexpected JSON output %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := run(ctx, in, []string{"deregister", "msg://boat", "127.0.0.1:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range etcd.Leases() {
+		if id == st.Lease {
+			t.Fatalf("lease %x not revoked", st.Lease)
+		}
+	}
+	if err := run(ctx, in, []string{"deregister", "msg://boat", "127.0.0.1:9090"}); err == nil {
+		t.Fatal("deregistered a missing instance")
+	}
+	if err := run(ctx, in, []string{"deregister", "msg://boat"}); err != errUsage {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buf := &syncBuffer{}
+	in := &inspector{c: c, w: buf, errW: buf, timeout: time.Second, resyncDelay: 10 * time.Millisecond}
+	doneC := make(chan error, 1)
+	go func() { doneC <- run(ctx, in, []string{"watch", "msg://"}) }()
+
+	r := registry.NewRegister(etcd.NewClient(), "msg://boat", "127.0.0.1:8080", 30)
+	st := waitRegistered(t, r)
+	etcd.ExpireLease(st.Lease)
+	r.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for strings.Count(buf.String(), "DELETE msg://boat 127.0.0.1:8080") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected output:\n%s", buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(buf.String(), "PUT msg://boat 127.0.0.1:8080") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+
+	cancel()
+	if err := <-doneC; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchJSON(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out, errOut := &syncBuffer{}, &syncBuffer{}
+	in := &inspector{c: c, w: out, errW: errOut, json: true, timeout: time.Second, resyncDelay: 10 * time.Millisecond}
+	doneC := make(chan error, 1)
+	go func() { doneC <- run(ctx, in, []string{"watch", "msg://"}) }()
+
+	r := registry.NewRegister(etcd.NewClient(), "msg://boat", "127.0.0.1:8080", 30)
+	defer r.Close()
+	waitRegistered(t, r)
+	wait := func(b *syncBuffer, s string) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !strings.Contains(b.String(), s) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%q not found in output:\n%s", s, b.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	wait(out, `"event":"PUT"`)
+
+	// 压缩后恢复的 watch 失败，重新同步
+	writer := etcd.NewClient()
+	etcd.Partition(c)
+	if _, err := writer.Put(context.Background(), "msg://boat/bad", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Compact(context.Background(), etcd.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	etcd.Heal(c)
+	wait(errOut, "# watch failed")
+	wait(errOut, "# skip")
+
+	cancel()
+	if err := <-doneC; err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Fatalf("invalid json line %q in output:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/molon/pkg/plog"
+)
+
+// Decoder decodes data into v, which is a pointer.
+type Decoder func(data []byte, v interface{}) error
+
+var (
+	// JSON decodes JSON values.
+	JSON Decoder = json.Unmarshal
+	// YAML decodes YAML values, or JSON since it is a subset of YAML.
+	YAML Decoder = yaml.Unmarshal
+)
+
+// Validator is implemented by the config values which validate themselves.
+// Validate is called after every decoding, the value is not published if it
+// returns an error.
+type Validator interface {
+	Validate() error
+}
+
+type options struct {
+	prefix     bool
+	decoder    Decoder
+	validators []func(v interface{}) error
+	errHandler func(err error)
+}
+
+// Option configures Watcher.
+type Option func(*options)
+
+// WithPrefix watches the keys under the key as a prefix, instead of the key
+// itself. Their values are decoded into the same value in key order, so the
+// later keys override the fields set by the earlier ones, e.g.
+//
+//	/config/app/00-default.yaml
+//	/config/app/10-canary.yaml
+func WithPrefix() Option {
+	return func(o *options) {
+		o.prefix = true
+	}
+}
+
+// WithDecoder sets the Decoder of all values. If not set, the values of the
+// keys ending with ".yaml" or ".yml" are decoded as YAML, the others as JSON.
+func WithDecoder(decoder Decoder) Option {
+	return func(o *options) {
+		o.decoder = decoder
+	}
+}
+
+// WithValidator adds a validation of the decoded values, which is called
+// after Validate of Validator.
+func WithValidator(validate func(v interface{}) error) Option {
+	return func(o *options) {
+		o.validators = append(o.validators, validate)
+	}
+}
+
+// WithErrorHandler sets the handler of the errors after the initial load,
+// e.g. invalid values and watch failures. The previous value is kept on
+// errors. If not set, the errors are logged.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(o *options) {
+		o.errHandler = handler
+	}
+}
+
+func defaultOptions() *options {
+	return &options{
+		errHandler: func(err error) {
+			plog.Warnf("Config watcher: %v", err)
+		},
+	}
+}
+
+func (o *options) decoderOf(key string) Decoder {
+	if o.decoder != nil {
+		return o.decoder
+	}
+	switch strings.ToLower(path.Ext(key)) {
+	case ".yaml", ".yml":
+		return YAML
+	default:
+		return JSON
+	}
+}
@@ -0,0 +1,213 @@
+// Package config keeps configuration stored in etcd decoded into a value,
+// which is updated whenever the configuration changes.
+package config
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/etcdsync"
+	"github.com/molon/pkg/putil"
+)
+
+// resyncDelay 是 watch 失败后重新同步的间隔
+const resyncDelay = time.Second
+
+// ChangeFunc is called with the previous and the current value when the
+// value changes.
+type ChangeFunc func(old, cur interface{})
+
+// Watcher watches a key, or the keys under a prefix with WithPrefix, and
+// decodes the values into a value of the type of the default value given to
+// NewWatcher. The current value is replaced atomically as a whole, so the
+// values returned by Load must be treated as read-only.
+//
+// If the watch fails, e.g. the revision has been compacted, it fetches the
+// values again and watches from the new revision, so no change is missed.
+type Watcher struct {
+	c    *v3.Client
+	key  string
+	opts *options
+	def  interface{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	doneC  chan struct{}
+
+	value atomic.Value
+	rev   int64
+
+	mu        sync.Mutex
+	callbacks map[int]ChangeFunc
+	nextID    int
+
+	// 只在 watch 循环中访问
+	s *etcdsync.Syncer
+}
+
+// NewWatcher loads the value of key into a copy of def, a pointer to the
+// default value which the keys override, and keeps it updated until Close.
+// The missing key, or the prefix without keys, has the default value.
+// It returns an error if the initial load fails or the value is invalid.
+func NewWatcher(ctx context.Context, c *v3.Client, key string, def interface{}, opts ...Option) (*Watcher, error) {
+	if v := reflect.ValueOf(def); v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, errors.Errorf("config: default value must be a non-nil pointer, got %T", def)
+	}
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	wctx, cancel := context.WithCancel(c.Ctx())
+	w := &Watcher{
+		c:         c,
+		key:       key,
+		opts:      o,
+		def:       def,
+		ctx:       wctx,
+		cancel:    cancel,
+		doneC:     make(chan struct{}),
+		callbacks: make(map[int]ChangeFunc),
+	}
+	sOpts := []etcdsync.Option{etcdsync.WithWatchErrorHandler(o.errHandler)}
+	if o.prefix {
+		sOpts = append(sOpts, etcdsync.WithPrefix())
+	}
+	w.s = etcdsync.NewSyncer(wctx, c, key, sOpts...)
+
+	// 首次加载使用调用方的ctx，失败直接返回
+	if _, err := w.s.Next(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := w.apply(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Load returns the current value, a pointer of the type of the default value.
+func (w *Watcher) Load() interface{} { return w.value.Load() }
+
+// Revision returns the etcd revision the value has caught up with.
+func (w *Watcher) Revision() int64 { return atomic.LoadInt64(&w.rev) }
+
+// OnChange adds fn to be called after the value changes, and returns a func
+// to remove it. The callbacks are called one by one in the watch goroutine,
+// so they should not block.
+func (w *Watcher) OnChange(fn ChangeFunc) func() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	id := w.nextID
+	w.nextID++
+	w.callbacks[id] = fn
+
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.callbacks, id)
+	}
+}
+
+// Done returns a channel which is closed after Close or the etcd client is
+// closed.
+func (w *Watcher) Done() <-chan struct{} { return w.doneC }
+
+// Close stops watching. The last value is still returned by Load.
+func (w *Watcher) Close() {
+	w.cancel()
+	<-w.doneC
+}
+
+func (w *Watcher) run() {
+	defer close(w.doneC)
+
+	for {
+		// watch 失败(例如 ErrCompacted)时 Syncer 会重新全量同步，同步失败则稍后重试
+		_, err := w.s.Next(w.ctx)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.opts.errHandler(err)
+			if putil.Sleep(w.ctx, resyncDelay) != nil {
+				return
+			}
+			continue
+		}
+		// 无效的值不发布，保留之前的值，以便之后的修正能生效
+		if err := w.apply(); err != nil {
+			w.opts.errHandler(err)
+		}
+	}
+}
+
+// apply 解码并校验已知的值，变化时发布并通知回调
+func (w *Watcher) apply() error {
+	cur, err := w.decode()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&w.rev, w.s.Revision())
+
+	old := w.Load()
+	if old != nil && reflect.DeepEqual(old, cur) {
+		return nil
+	}
+	w.value.Store(cur)
+	if old == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	ids := make([]int, 0, len(w.callbacks))
+	for id := range w.callbacks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	callbacks := make([]ChangeFunc, len(ids))
+	for i, id := range ids {
+		callbacks[i] = w.callbacks[id]
+	}
+	w.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(old, cur)
+	}
+	return nil
+}
+
+func (w *Watcher) decode() (interface{}, error) {
+	v := reflect.New(reflect.TypeOf(w.def).Elem()).Interface()
+	if err := putil.JsonDeepCopy(v, w.def); err != nil {
+		return nil, errors.Wrap(err, "copy default value")
+	}
+
+	for _, kv := range w.s.KVs() {
+		if err := w.opts.decoderOf(string(kv.Key))(kv.Value, v); err != nil {
+			return nil, errors.Wrapf(err, "decode %q", kv.Key)
+		}
+	}
+
+	if vd, ok := v.(Validator); ok {
+		if err := vd.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "validate %q", w.key)
+		}
+	}
+	for _, validate := range w.opts.validators {
+		if err := validate(v); err != nil {
+			return nil, errors.Wrapf(err, "validate %q", w.key)
+		}
+	}
+	return v, nil
+}
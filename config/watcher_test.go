@@ -0,0 +1,140 @@
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/registry/registrytest"
+)
+
+type feature struct {
+	Enabled bool     `json:"enabled"`
+	Limit   int      `json:"limit"`
+	Users   []string `json:"users,omitempty"`
+}
+
+func (f *feature) Validate() error {
+	if f.Limit < 0 {
+		return errors.New("negative limit")
+	}
+	return nil
+}
+
+func waitValue(t *testing.T, w *Watcher, want func(f *feature) bool) *feature {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		f := w.Load().(*feature)
+		if want(f) {
+			return f
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for the value, current %+v", f)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx := context.Background()
+
+	errC := make(chan error, 10)
+	w, err := NewWatcher(ctx, c, "/config/feature.yaml", &feature{Limit: 10},
+		WithErrorHandler(func(err error) { errC <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if f := w.Load().(*feature); f.Enabled || f.Limit != 10 {
+		t.Fatalf("unexpected default value %+v", f)
+	}
+
+	changeC := make(chan [2]*feature, 10)
+	w.OnChange(func(old, cur interface{}) {
+		changeC <- [2]*feature{old.(*feature), cur.(*feature)}
+	})
+
+	c.Put(ctx, "/config/feature.yaml", "enabled: true")
+	select {
+	case ch := <-changeC:
+		if ch[0].Enabled || !ch[1].Enabled || ch[1].Limit != 10 {
+			t.Fatalf("unexpected change %+v -> %+v", ch[0], ch[1])
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the change")
+	}
+
+	// 无效的值不发布，保留之前的值
+	c.Put(ctx, "/config/feature.yaml", "limit: -1")
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Fatal("nil error")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("invalid value not reported")
+	}
+	if f := w.Load().(*feature); !f.Enabled || f.Limit != 10 {
+		t.Fatalf("invalid value published %+v", f)
+	}
+
+	c.Delete(ctx, "/config/feature.yaml")
+	waitValue(t, w, func(f *feature) bool { return !f.Enabled && f.Limit == 10 })
+	if w.Revision() != etcd.Revision() {
+		t.Fatalf("revision %d, want %d", w.Revision(), etcd.Revision())
+	}
+}
+
+func TestWatcherInvalidInitial(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx := context.Background()
+
+	c.Put(ctx, "/config/feature", `{"limit": -1}`)
+	if _, err := NewWatcher(ctx, c, "/config/feature", &feature{}); err == nil {
+		t.Fatal("invalid initial value accepted")
+	}
+}
+
+func TestWatcherPrefixResync(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c, writer := etcd.NewClient(), etcd.NewClient()
+	ctx := context.Background()
+
+	writer.Put(ctx, "/config/app/00-default", `{"enabled": true, "limit": 1}`)
+	writer.Put(ctx, "/config/app/10-override", `{"limit": 2}`)
+
+	w, err := NewWatcher(ctx, c, "/config/app/", &feature{}, WithPrefix(),
+		WithErrorHandler(func(error) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if f := w.Load().(*feature); !f.Enabled || f.Limit != 2 {
+		t.Fatalf("unexpected merged value %+v", f)
+	}
+
+	// 分区期间的变化被压缩，恢复后 watch 失败，需要重新同步
+	etcd.Partition(c)
+	writer.Put(ctx, "/config/app/10-override", `{"limit": 3}`)
+	writer.Put(ctx, "/config/app/20-users", `{"users": ["a"]}`)
+	if _, err := writer.Compact(ctx, etcd.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	etcd.Heal(c)
+
+	f := waitValue(t, w, func(f *feature) bool { return f.Limit == 3 && len(f.Users) == 1 })
+	if !f.Enabled {
+		t.Fatalf("unexpected value %+v", f)
+	}
+	if w.Revision() != etcd.Revision() {
+		t.Fatalf("revision %d, want %d", w.Revision(), etcd.Revision())
+	}
+}
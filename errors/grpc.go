@@ -51,6 +51,40 @@ func StreamServerInterceptor(options ...InterceptorOption) grpc.StreamServerInte
 	}
 }
 
+// UnaryClientInterceptor converts the errors returned by the calls with the
+// handler set by WithErrorHandler, e.g. to map status errors to local ones.
+func UnaryClientInterceptor(options ...InterceptorOption) grpc.UnaryClientInterceptor {
+	opts := &interceptorOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+
+	return func(ctx context.Context, method string, req, resp interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, resp, cc, callOpts...)
+		if err != nil && opts.errHandler != nil {
+			err = opts.errHandler(err)
+		}
+		return err
+	}
+}
+
+// StreamClientInterceptor is like UnaryClientInterceptor, but only the error
+// of creating the stream is converted.
+func StreamClientInterceptor(options ...InterceptorOption) grpc.StreamClientInterceptor {
+	opts := &interceptorOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(ctx, desc, cc, method, callOpts...)
+		if err != nil && opts.errHandler != nil {
+			err = opts.errHandler(err)
+		}
+		return cs, err
+	}
+}
+
 func Statusf(c codes.Code, format string, a ...interface{}) error {
 	return WithStack(status.Errorf(c, format, a...))
 }
@@ -0,0 +1,223 @@
+// Package etcdsync keeps a key, or the keys under a prefix, in sync with etcd
+// across watch failures.
+package etcdsync
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/molon/pkg/errors"
+)
+
+// Option configures a Syncer.
+type Option func(*Syncer)
+
+// WithPrefix syncs the keys prefixed with the key given to NewSyncer.
+func WithPrefix() Option {
+	return func(s *Syncer) {
+		s.getOpts = append(s.getOpts, v3.WithPrefix())
+		s.watchOpts = append(s.watchOpts, v3.WithPrefix())
+	}
+}
+
+// WithSerializable gets the keys with serializable reads, which may be
+// served by any member but may be stale.
+func WithSerializable() Option {
+	return func(s *Syncer) {
+		s.getOpts = append(s.getOpts, v3.WithSerializable())
+	}
+}
+
+// WithWatchErrorHandler sets the handler of the watch failures, which are
+// followed by a resync. If not set, they are ignored.
+func WithWatchErrorHandler(fn func(err error)) Option {
+	return func(s *Syncer) {
+		s.watchErrHandler = fn
+	}
+}
+
+// Syncer watches a key, or the keys under a prefix with WithPrefix, and keeps
+// the current key-values. If the watch fails, e.g. the revision has been
+// compacted or the watch is canceled by a leader change, it gets the keys
+// again, synthesizes the events missed from the difference with the known
+// key-values, and watches from the new revision, so no change is missed.
+//
+// Next must not be called concurrently, neither KVs with Next.
+type Syncer struct {
+	c   *v3.Client
+	key string
+
+	getOpts         []v3.OpOption
+	watchOpts       []v3.OpOption
+	watchErrHandler func(err error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 当前的watch，失败后置为nil，下次 Next 时重新同步
+	wch     v3.WatchChan
+	wcancel context.CancelFunc
+	// 当前已知的全量记录，用于重新同步时生成错过的事件
+	known map[string]*mvccpb.KeyValue
+	rev   int64
+}
+
+// NewSyncer creates a Syncer of key, which watches until ctx is done or
+// Close.
+func NewSyncer(ctx context.Context, c *v3.Client, key string, opts ...Option) *Syncer {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Syncer{
+		c:      c,
+		key:    key,
+		ctx:    ctx,
+		cancel: cancel,
+		known:  make(map[string]*mvccpb.KeyValue),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Next blocks until the next changes, ctx or the ctx of the Syncer is done.
+// The first call returns the current key-values as PUT events. The DELETE
+// events always carry PrevKv. If the watch fails, Next resyncs at once; if
+// that fails as well, it returns the error, and the following call resyncs
+// again.
+func (s *Syncer) Next(ctx context.Context) ([]*v3.Event, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if s.wch == nil {
+		return s.sync(ctx)
+	}
+
+	var wr v3.WatchResponse
+	var ok bool
+	select {
+	case wr, ok = <-s.wch:
+	case <-ctx.Done():
+		return nil, errors.WithStack(ctx.Err())
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var err error
+	switch {
+	case !ok:
+		err = errors.Errorf("watch %q closed", s.key)
+	case wr.Err() != nil:
+		err = errors.Wrapf(wr.Err(), "watch %q", s.key)
+	case wr.Canceled:
+		err = errors.Errorf("watch %q canceled", s.key)
+	}
+	if err != nil {
+		// 例如 ErrCompacted，leader 变更导致的取消等，重新全量同步
+		if s.watchErrHandler != nil {
+			s.watchErrHandler(err)
+		}
+		s.stopWatch()
+		return s.sync(ctx)
+	}
+
+	for _, ev := range wr.Events {
+		key := string(ev.Kv.Key)
+		switch ev.Type {
+		case mvccpb.PUT:
+			s.known[key] = ev.Kv
+		case mvccpb.DELETE:
+			if ev.PrevKv == nil {
+				ev.PrevKv = s.known[key]
+			}
+			delete(s.known, key)
+		}
+	}
+	atomic.StoreInt64(&s.rev, wr.Header.Revision)
+	return wr.Events, nil
+}
+
+// sync 全量获取并与已知记录对比生成事件，然后从新的版本开始watch
+func (s *Syncer) sync(ctx context.Context) ([]*v3.Event, error) {
+	// Close 也取消正在进行的获取
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := s.c.Get(ctx, s.key, s.getOpts...)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return nil, errors.WithStack(s.ctx.Err())
+		}
+		return nil, errors.Wrapf(err, "get %q", s.key)
+	}
+
+	cur := make(map[string]*mvccpb.KeyValue, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		cur[string(kv.Key)] = kv
+	}
+	events := diff(s.known, cur, resp.Header.Revision)
+	s.known = cur
+	atomic.StoreInt64(&s.rev, resp.Header.Revision)
+
+	wctx, wcancel := context.WithCancel(s.ctx)
+	opts := append([]v3.OpOption{v3.WithRev(resp.Header.Revision + 1), v3.WithPrevKV()}, s.watchOpts...)
+	s.wch = s.c.Watch(wctx, s.key, opts...)
+	s.wcancel = wcancel
+	return events, nil
+}
+
+func (s *Syncer) stopWatch() {
+	if s.wcancel != nil {
+		s.wcancel()
+	}
+	s.wch, s.wcancel = nil, nil
+}
+
+// diff 对比新旧两份全量记录，按 key 的顺序生成 PUT/DELETE 事件
+func diff(old, cur map[string]*mvccpb.KeyValue, rev int64) []*v3.Event {
+	var events []*v3.Event
+	for key, kv := range old {
+		if _, ok := cur[key]; !ok {
+			events = append(events, &v3.Event{
+				Type:   mvccpb.DELETE,
+				Kv:     &mvccpb.KeyValue{Key: kv.Key, ModRevision: rev},
+				PrevKv: kv,
+			})
+		}
+	}
+	for key, kv := range cur {
+		if okv, ok := old[key]; ok && okv.ModRevision == kv.ModRevision {
+			continue
+		}
+		events = append(events, &v3.Event{Type: mvccpb.PUT, Kv: kv, PrevKv: old[key]})
+	}
+	sort.Slice(events, func(i, j int) bool { return string(events[i].Kv.Key) < string(events[j].Kv.Key) })
+	return events
+}
+
+// KVs returns the current key-values in the order of the keys.
+func (s *Syncer) KVs() []*mvccpb.KeyValue {
+	kvs := make([]*mvccpb.KeyValue, 0, len(s.known))
+	for _, kv := range s.known {
+		kvs = append(kvs, kv)
+	}
+	sort.Slice(kvs, func(i, j int) bool { return string(kvs[i].Key) < string(kvs[j].Key) })
+	return kvs
+}
+
+// Revision returns the etcd revision the Syncer has caught up with, 0 before
+// the first sync.
+func (s *Syncer) Revision() int64 { return atomic.LoadInt64(&s.rev) }
+
+// Close stops watching.
+func (s *Syncer) Close() { s.cancel() }
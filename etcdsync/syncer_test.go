@@ -0,0 +1,79 @@
+package etcdsync
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/molon/pkg/registry/registrytest"
+)
+
+func formatEvents(events []*v3.Event) string {
+	s := make([]string, len(events))
+	for i, ev := range events {
+		s[i] = ev.Type.String() + " " + string(ev.Kv.Key) + "=" + string(ev.Kv.Value)
+		if ev.PrevKv != nil {
+			s[i] += " prev=" + string(ev.PrevKv.Value)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func TestSyncer(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c, writer := etcd.NewClient(), etcd.NewClient()
+	ctx := context.Background()
+
+	writer.Put(ctx, "/app/a", "1")
+	writer.Put(ctx, "/app/b", "1")
+	writer.Put(ctx, "/apps", "1")
+
+	var watchErrs []error
+	s := NewSyncer(ctx, c, "/app/", WithPrefix(), WithWatchErrorHandler(func(err error) { watchErrs = append(watchErrs, err) }))
+	defer s.Close()
+
+	next := func(want string) {
+		t.Helper()
+		events, err := s.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatEvents(events); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	next("PUT /app/a=1,PUT /app/b=1")
+	writer.Put(ctx, "/app/a", "2")
+	next("PUT /app/a=2 prev=1")
+	writer.Delete(ctx, "/app/b")
+	next("DELETE /app/b= prev=1")
+
+	// 分区期间的变化被压缩，恢复后 watch 失败，重新同步并生成错过的事件
+	etcd.Partition(c)
+	writer.Put(ctx, "/app/b", "2")
+	writer.Delete(ctx, "/app/a")
+	writer.Put(ctx, "/app/c", "1")
+	writer.Put(ctx, "/app/c", "2")
+	if _, err := writer.Compact(ctx, etcd.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	etcd.Heal(c)
+
+	next("DELETE /app/a= prev=2,PUT /app/b=2,PUT /app/c=2")
+	if len(watchErrs) != 1 {
+		t.Fatalf("unexpected watch errors %v", watchErrs)
+	}
+	if s.Revision() != etcd.Revision() {
+		t.Fatalf("revision %d, want %d", s.Revision(), etcd.Revision())
+	}
+	if kvs := s.KVs(); len(kvs) != 2 || string(kvs[0].Key) != "/app/b" || string(kvs[1].Key) != "/app/c" {
+		t.Fatalf("unexpected key-values %v", kvs)
+	}
+
+	s.Close()
+	if _, err := s.Next(ctx); err == nil {
+		t.Fatal("nil error after Close")
+	}
+}
@@ -0,0 +1,405 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/plog"
+	"github.com/molon/pkg/putil"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrElectionNotLeader   = errors.New("election: not leader")
+	ErrElectionNoLeader    = errors.New("election: no leader")
+	ErrElectionCampaigning = errors.New("election: already campaigning")
+)
+
+const observeRetryDelay = time.Second
+
+// Election is a leader election under a key prefix, like the one of
+// clientv3/concurrency, on a Session given by the caller. Once Campaign has
+// been called, it keeps campaigning until Resign: if the Session expires, it
+// campaigns again on a new Session with the same TTL, which it owns.
+type Election struct {
+	s         *Session
+	c         *v3.Client
+	keyPrefix string
+
+	mu     sync.Mutex
+	val    string
+	leader bool
+	// 当前候选的 key 及其 session，未在竞选时为空
+	key string
+	rev int64
+	ss  *Session
+
+	// 竞选循环，未在竞选时为nil
+	cancel context.CancelFunc
+	loopC  chan struct{}
+}
+
+// NewElection returns a new election on prefix campaigning on s. The
+// Election never closes s, only the Sessions it creates after s expires.
+func NewElection(s *Session, prefix string) *Election {
+	return &Election{s: s, c: s.Client(), keyPrefix: prefix + "/"}
+}
+
+// Campaign puts val as eligible for the election and blocks until it is
+// elected, ctx is done or Resign is called. If ctx is done before that, the
+// campaign is abandoned. After Campaign returns nil, the Election
+// re-campaigns automatically whenever the session expires, use IsLeader or
+// Observe to learn whether it is still the leader.
+func (e *Election) Campaign(ctx context.Context, val string) error {
+	e.mu.Lock()
+	if e.cancel != nil {
+		e.mu.Unlock()
+		return errors.WithStack(ErrElectionCampaigning)
+	}
+	lctx, cancel := context.WithCancel(e.c.Ctx())
+	loopC := make(chan struct{})
+	electedC := make(chan struct{})
+	e.val = val
+	e.cancel = cancel
+	e.loopC = loopC
+	e.mu.Unlock()
+
+	go e.loop(lctx, loopC, electedC)
+
+	select {
+	case <-electedC:
+		return nil
+	case <-loopC:
+		return errors.WithStack(context.Canceled)
+	case <-ctx.Done():
+		e.stop()
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+func (e *Election) loop(ctx context.Context, loopC chan struct{}, electedC chan struct{}) {
+	defer close(loopC)
+
+	var once sync.Once
+	rm := rate.NewLimiter(rate.Limit(registerRetryRate), registerRetryRate)
+	for rm.Wait(ctx) == nil {
+		ss, err := e.session()
+		if err != nil {
+			plog.Warnf("Election %q NewSession: %v", e.keyPrefix, err)
+			continue
+		}
+
+		if err := e.campaign(ctx, ss); err != nil {
+			e.setSession(nil)
+			e.release(ss)
+			if ctx.Err() != nil {
+				return
+			}
+			plog.Warnf("Election %q campaign: %v", e.keyPrefix, err)
+			continue
+		}
+
+		once.Do(func() { close(electedC) })
+		plog.Infof("Elected as leader of %q with lease %x", e.keyPrefix, ss.Lease())
+
+		select {
+		case <-ctx.Done():
+			e.setSession(nil)
+			if err := e.release(ss); err != nil {
+				plog.Warnf("Ctx done, election release: %v", err)
+			}
+			return
+
+		case <-ss.Done():
+			e.setSession(nil)
+			plog.Warnf("Election %q session expired, leadership lost", e.keyPrefix)
+			plog.Warn("Creating a new session to campaign again")
+			continue
+		}
+	}
+}
+
+// session 返回用于竞选的 session，调用方的 session 过期后创建新的
+func (e *Election) session() (*Session, error) {
+	select {
+	case <-e.s.Done():
+	default:
+		return e.s, nil
+	}
+	return NewSession(e.c, WithTTL(e.s.opts.ttl), WithContext(e.c.Ctx()))
+}
+
+// release 放弃在 ss 上的候选，调用方的 session 不关闭，只删除候选 key
+func (e *Election) release(ss *Session) error {
+	if ss != e.s {
+		return ss.Close()
+	}
+	ctx, cancel := context.WithTimeout(e.c.Ctx(), time.Duration(ss.opts.ttl)*time.Second)
+	defer cancel()
+	_, err := e.c.Delete(ctx, e.candidateKey(ss))
+	return errors.WithStack(err)
+}
+
+func (e *Election) candidateKey(ss *Session) string {
+	return fmt.Sprintf("%s%x", e.keyPrefix, ss.Lease())
+}
+
+// campaign 在 ss 上竞选，直到当选或 ss 失效
+func (e *Election) campaign(ctx context.Context, ss *Session) error {
+	ctx, cancel := sessionContext(ctx, ss)
+	defer cancel()
+
+	e.mu.Lock()
+	val := e.val
+	e.mu.Unlock()
+
+	k := e.candidateKey(ss)
+	txn := e.c.Txn(ctx).If(v3.Compare(v3.CreateRevision(k), "=", 0))
+	txn = txn.Then(v3.OpPut(k, val, v3.WithLease(ss.Lease())))
+	txn = txn.Else(v3.OpGet(k))
+	resp, err := txn.Commit()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rev := resp.Header.Revision
+	if !resp.Succeeded {
+		kv := resp.Responses[0].GetResponseRange().Kvs[0]
+		rev = kv.CreateRevision
+		if string(kv.Value) != val {
+			if _, err := e.c.Put(ctx, k, val, v3.WithLease(ss.Lease())); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	e.mu.Lock()
+	e.key, e.rev, e.ss = k, rev, ss
+	e.mu.Unlock()
+
+	if _, err := waitDeletes(ctx, e.c, e.keyPrefix, rev-1); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-ss.Done():
+		return errors.New("session expired before elected")
+	default:
+	}
+	e.leader = true
+	return nil
+}
+
+// setSession 须在竞选循环中调用
+func (e *Election) setSession(ss *Session) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ss = ss
+	if ss == nil {
+		e.key, e.rev, e.leader = "", 0, false
+	}
+}
+
+func (e *Election) stop() {
+	e.mu.Lock()
+	cancel, loopC := e.cancel, e.loopC
+	e.cancel, e.loopC = nil, nil
+	e.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-loopC
+	}
+}
+
+// Proclaim lets the leader announce a new value without another election.
+// The value is also used by the following campaigns.
+func (e *Election) Proclaim(ctx context.Context, val string) error {
+	// 不在持有锁时访问 etcd
+	e.mu.Lock()
+	leader, key, rev, ss := e.leader, e.key, e.rev, e.ss
+	e.mu.Unlock()
+
+	if !leader {
+		return errors.WithStack(ErrElectionNotLeader)
+	}
+	cmp := v3.Compare(v3.CreateRevision(key), "=", rev)
+	txn := e.c.Txn(ctx).If(cmp)
+	txn = txn.Then(v3.OpPut(key, val, v3.WithLease(ss.Lease())))
+	tresp, err := txn.Commit()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !tresp.Succeeded {
+		return errors.WithStack(ErrElectionNotLeader)
+	}
+
+	e.mu.Lock()
+	e.val = val
+	e.mu.Unlock()
+	return nil
+}
+
+// Resign stops campaigning and gives up the leadership by deleting the
+// candidate key, or revoking the lease of a Session created by the Election.
+// It returns when that is done or ctx is done. In the latter case it goes on
+// in the background, and the leadership is given up once it finishes or the
+// lease expires.
+func (e *Election) Resign(ctx context.Context) error {
+	doneC := make(chan struct{})
+	go func() {
+		e.stop()
+		close(doneC)
+	}()
+	select {
+	case <-doneC:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+// IsLeader reports whether the Election is currently the leader.
+func (e *Election) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Key returns the candidate key of the current campaign, empty string if not
+// campaigning.
+func (e *Election) Key() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.key
+}
+
+// Leader returns the leader value for the current election.
+func (e *Election) Leader(ctx context.Context) (*v3.GetResponse, error) {
+	resp, err := e.c.Get(ctx, e.keyPrefix, v3.WithFirstCreate()...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	} else if len(resp.Kvs) == 0 {
+		// no leader currently elected
+		return nil, errors.WithStack(ErrElectionNoLeader)
+	}
+	return resp, nil
+}
+
+// Observe returns a channel that observes the leader proposals as
+// GetResponse values on every current elected leader key. Unlike the one of
+// clientv3/concurrency, it survives watch failures by fetching the leader
+// again, so only the most recent value is guaranteed to be posted.
+//
+// The channel closes when the context is canceled.
+func (e *Election) Observe(ctx context.Context) <-chan v3.GetResponse {
+	retc := make(chan v3.GetResponse)
+	go func() {
+		defer close(retc)
+
+		var last *mvccpb.KeyValue
+		for {
+			err := e.observe(ctx, retc, &last)
+			if ctx.Err() != nil {
+				return
+			}
+			plog.Warnf("Election %q observe: %v", e.keyPrefix, err)
+			if putil.Sleep(ctx, observeRetryDelay) != nil {
+				return
+			}
+		}
+	}()
+	return retc
+}
+
+// observe 持续发送 leader 的变化直到出错，last 用于在重试后去重
+func (e *Election) observe(ctx context.Context, ch chan<- v3.GetResponse, last **mvccpb.KeyValue) error {
+	send := func(resp v3.GetResponse) error {
+		kv := resp.Kvs[0]
+		if *last != nil && string((*last).Key) == string(kv.Key) && (*last).ModRevision == kv.ModRevision {
+			return nil
+		}
+		select {
+		case ch <- resp:
+			*last = kv
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for {
+		resp, err := e.c.Get(ctx, e.keyPrefix, v3.WithFirstCreate()...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		var kv *mvccpb.KeyValue
+		hdr := resp.Header
+		if len(resp.Kvs) == 0 {
+			cctx, cancel := context.WithCancel(ctx)
+			// wait for first key put on prefix
+			opts := []v3.OpOption{v3.WithRev(resp.Header.Revision), v3.WithPrefix()}
+			wch := e.c.Watch(cctx, e.keyPrefix, opts...)
+			for kv == nil {
+				wr, ok := <-wch
+				if !ok || wr.Err() != nil {
+					cancel()
+					if !ok {
+						return errors.New("watch closed")
+					}
+					return errors.WithStack(wr.Err())
+				}
+				// only accept puts; a delete will make observe() spin
+				for _, ev := range wr.Events {
+					if ev.Type == mvccpb.PUT {
+						h := wr.Header
+						hdr, kv = &h, ev.Kv
+						// set to kv's rev in case batch has multiple Puts
+						hdr.Revision = kv.ModRevision
+						break
+					}
+				}
+			}
+			cancel()
+		} else {
+			kv = resp.Kvs[0]
+		}
+
+		if err := send(v3.GetResponse{Header: hdr, Kvs: []*mvccpb.KeyValue{kv}}); err != nil {
+			return err
+		}
+
+		cctx, cancel := context.WithCancel(ctx)
+		wch := e.c.Watch(cctx, string(kv.Key), v3.WithRev(hdr.Revision+1))
+		keyDeleted := false
+		for !keyDeleted {
+			wr, ok := <-wch
+			if !ok || wr.Err() != nil {
+				cancel()
+				if !ok {
+					return errors.New("watch closed")
+				}
+				return errors.WithStack(wr.Err())
+			}
+			for _, ev := range wr.Events {
+				if ev.Type == mvccpb.DELETE {
+					keyDeleted = true
+					break
+				}
+				h := wr.Header
+				if err := send(v3.GetResponse{Header: &h, Kvs: []*mvccpb.KeyValue{ev.Kv}}); err != nil {
+					cancel()
+					return err
+				}
+			}
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,106 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/molon/pkg/registry/registrytest"
+)
+
+func TestElectionFailover(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx := context.Background()
+
+	s1, err := NewSession(c, WithTTL(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2, err := NewSession(c, WithTTL(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	e1, e2 := NewElection(s1, "test/election"), NewElection(s2, "test/election")
+	defer e1.Resign(ctx)
+
+	if err := e1.Campaign(ctx, "e1"); err != nil {
+		t.Fatal(err)
+	}
+	electedC := make(chan error, 1)
+	go func() { electedC <- e2.Campaign(ctx, "e2") }()
+
+	obsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	obs := e1.Observe(obsCtx)
+	if resp := <-obs; string(resp.Kvs[0].Value) != "e1" {
+		t.Fatalf("unexpected leader %q", resp.Kvs[0].Value)
+	}
+
+	// leader 的 session 过期后 e2 当选，e1 在新的 session 上重新竞选
+	resp, err := e1.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v3.LeaseID(resp.Kvs[0].Lease) != s1.Lease() {
+		t.Fatalf("leader not on the given session")
+	}
+	etcd.ExpireLease(s1.Lease())
+	select {
+	case err := <-electedC:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for failover")
+	}
+	select {
+	case resp := <-obs:
+		if string(resp.Kvs[0].Value) != "e2" {
+			t.Fatalf("unexpected leader %q", resp.Kvs[0].Value)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout observing the new leader")
+	}
+	if !e2.IsLeader() {
+		t.Fatal("e2 is not leader")
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for e1.Key() == "" || e1.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatalf("e1 not campaigning again, key %q leader %v", e1.Key(), e1.IsLeader())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 放弃时只删除候选 key，不关闭调用方的 session
+	key := e2.Key()
+	if err := e2.Proclaim(ctx, "e2-updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e2.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s2.Get(ctx, key); err != nil || ok {
+		t.Fatalf("candidate key %q not deleted: %v", key, err)
+	}
+	select {
+	case <-s2.Done():
+		t.Fatal("session closed by Resign")
+	default:
+	}
+	select {
+	case resp := <-obs:
+		if string(resp.Kvs[0].Value) != "e2-updated" {
+			t.Fatalf("unexpected leader %q", resp.Kvs[0].Value)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout observing the proclaimed value")
+	}
+}
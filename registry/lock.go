@@ -0,0 +1,260 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/molon/pkg/errors"
+)
+
+var (
+	// ErrLocked is returned by TryLock if the lock is held by others.
+	ErrLocked = errors.New("lock: held by others")
+	// ErrSessionExpired is returned by Lock if the session expires while waiting.
+	ErrSessionExpired = errors.New("lock: session expired")
+)
+
+// Semaphore is a counting semaphore held by at most limit sessions at a time.
+// Each holder has a key under the prefix bound to its session lease, so the
+// permit is released automatically when the session dies. The waiters are
+// granted the permits in the order they ask for them.
+type Semaphore struct {
+	s     *Session
+	pfx   string
+	limit int
+
+	// 串行化 Lock/TryLock/Unlock 对 etcd 的操作，等待期间不持有 mu
+	lockMu sync.Mutex
+
+	mu    sync.Mutex
+	myKey string
+	// 等待期间不为nil，Unlock 用它放弃等待
+	waitCancel context.CancelFunc
+	// 持有期间有效，失去或释放时关闭
+	doneC  chan struct{}
+	cancel context.CancelFunc
+}
+
+// NewSemaphore creates a Semaphore of limit permits on prefix. If limit <= 0,
+// 1 will be used.
+func NewSemaphore(s *Session, prefix string, limit int) *Semaphore {
+	if limit <= 0 {
+		limit = 1
+	}
+	return &Semaphore{s: s, pfx: prefix + "/", limit: limit}
+}
+
+// Lock blocks until a permit is acquired, ctx is done, Unlock is called or
+// the session expires. If it fails, the waiting key is removed.
+func (sem *Semaphore) Lock(ctx context.Context) error {
+	return sem.lock(ctx, true)
+}
+
+// TryLock acquires a permit without waiting, returning ErrLocked if there is
+// none available.
+func (sem *Semaphore) TryLock(ctx context.Context) error {
+	return sem.lock(ctx, false)
+}
+
+func (sem *Semaphore) lock(ctx context.Context, wait bool) error {
+	sem.lockMu.Lock()
+	defer sem.lockMu.Unlock()
+
+	ctx, cancel := sessionContext(ctx, sem.s)
+	defer cancel()
+
+	sem.mu.Lock()
+	if sem.doneC != nil {
+		select {
+		case <-sem.doneC:
+			// 之前持有的已失去，重新获取
+		default:
+			sem.mu.Unlock()
+			return nil
+		}
+	}
+	key := fmt.Sprintf("%s%x", sem.pfx, sem.s.Lease())
+	sem.myKey = key
+	sem.waitCancel = cancel
+	sem.mu.Unlock()
+
+	client := sem.s.Client()
+	cmp := v3.Compare(v3.CreateRevision(key), "=", 0)
+	// put self in waiters via myKey; oldest waiters hold the permits
+	put := v3.OpPut(key, "", v3.WithLease(sem.s.Lease()))
+	// reuse key in case this session already has it
+	get := v3.OpGet(key)
+	resp, err := client.Txn(ctx).If(cmp).Then(put).Else(get).Commit()
+	if err != nil {
+		return sem.fail(ctx, key, errors.WithStack(err))
+	}
+	myRev := resp.Header.Revision
+	if !resp.Succeeded {
+		myRev = resp.Responses[0].GetResponseRange().Kvs[0].CreateRevision
+	}
+
+	for {
+		rev, acquired, err := sem.acquired(ctx, myRev)
+		if err != nil {
+			return sem.fail(ctx, key, err)
+		}
+		if acquired {
+			break
+		}
+		if !wait {
+			return sem.fail(ctx, key, errors.WithStack(ErrLocked))
+		}
+		if err := sem.waitRelease(ctx, rev); err != nil {
+			return sem.fail(ctx, key, err)
+		}
+	}
+
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+	sem.waitCancel = nil
+	sem.hold(key, myRev)
+	return nil
+}
+
+// acquired 判断 myRev 之前（含）创建的 key 是否不超过 limit 个
+func (sem *Semaphore) acquired(ctx context.Context, myRev int64) (int64, bool, error) {
+	// Count 不受 MaxCreateRev 过滤的影响，只能数返回的 key
+	resp, err := sem.s.Client().Get(ctx, sem.pfx, v3.WithPrefix(), v3.WithMaxCreateRev(myRev), v3.WithKeysOnly())
+	if err != nil {
+		return 0, false, errors.WithStack(err)
+	}
+	return resp.Header.Revision, len(resp.Kvs) <= sem.limit, nil
+}
+
+// waitRelease 等待 rev 之后 prefix 下的任意删除
+func (sem *Semaphore) waitRelease(ctx context.Context, rev int64) error {
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wch := sem.s.Client().Watch(cctx, sem.pfx, v3.WithPrefix(), v3.WithRev(rev+1))
+	for wr := range wch {
+		if err := wr.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		for _, ev := range wr.Events {
+			if ev.Type == mvccpb.DELETE {
+				return nil
+			}
+		}
+	}
+	return sem.ctxErr(ctx)
+}
+
+// fail 删除等待的 key 并返回错误
+func (sem *Semaphore) fail(ctx context.Context, key string, err error) error {
+	// 因 session 失效或ctx结束导致的失败，返回更明确的原因
+	if ctx.Err() != nil && errors.Cause(err) != ErrLocked {
+		err = sem.ctxErr(ctx)
+	}
+	sem.s.Client().Delete(sem.s.Client().Ctx(), key)
+
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+	sem.waitCancel = nil
+	sem.myKey = ""
+	return err
+}
+
+func (sem *Semaphore) ctxErr(ctx context.Context) error {
+	select {
+	case <-sem.s.Done():
+		return errors.WithStack(ErrSessionExpired)
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.New("lost watcher waiting for release")
+}
+
+// hold 在持有期间监视 session 和 key，任一失效即关闭 doneC，须持有 sem.mu
+func (sem *Semaphore) hold(key string, rev int64) {
+	doneC := make(chan struct{})
+	ctx, cancel := sessionContext(sem.s.Client().Ctx(), sem.s)
+	sem.doneC = doneC
+	sem.cancel = cancel
+
+	go func() {
+		defer close(doneC)
+		defer cancel()
+
+		wch := sem.s.Client().Watch(ctx, key, v3.WithRev(rev+1))
+		for wr := range wch {
+			for _, ev := range wr.Events {
+				if ev.Type == mvccpb.DELETE {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Unlock releases the permit. If a Lock is waiting for the permit, it gives
+// up waiting and returns an error.
+func (sem *Semaphore) Unlock(ctx context.Context) error {
+	sem.mu.Lock()
+	if sem.waitCancel != nil {
+		sem.waitCancel()
+	}
+	sem.mu.Unlock()
+
+	// 等待中的 Lock 已被取消，很快会释放 lockMu
+	sem.lockMu.Lock()
+	defer sem.lockMu.Unlock()
+
+	sem.mu.Lock()
+	cancel, doneC, key := sem.cancel, sem.doneC, sem.myKey
+	sem.cancel = nil
+	sem.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-doneC
+	}
+	if key == "" {
+		return nil
+	}
+	if _, err := sem.s.Client().Delete(ctx, key); err != nil {
+		return errors.WithStack(err)
+	}
+
+	sem.mu.Lock()
+	sem.myKey = ""
+	sem.mu.Unlock()
+	return nil
+}
+
+// Done returns a channel that closes when the permit is released or lost,
+// e.g. the session expires or the key is deleted by others. It returns nil
+// if the permit has never been acquired.
+func (sem *Semaphore) Done() <-chan struct{} {
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+	return sem.doneC
+}
+
+// Key returns the key of the session under the prefix, empty string if not
+// holding or waiting.
+func (sem *Semaphore) Key() string {
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+	return sem.myKey
+}
+
+// Mutex is a Semaphore with a single permit.
+type Mutex struct {
+	*Semaphore
+}
+
+// NewMutex creates a Mutex on prefix.
+func NewMutex(s *Session, prefix string) *Mutex {
+	return &Mutex{NewSemaphore(s, prefix, 1)}
+}
@@ -0,0 +1,178 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/molon/pkg/errors"
+	"github.com/molon/pkg/registry/registrytest"
+)
+
+func TestMutex(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx := context.Background()
+
+	s1, err := NewSession(c, WithTTL(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewSession(c, WithTTL(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	s3, err := NewSession(c, WithTTL(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+
+	m1, m2, m3 := NewMutex(s1, "test/lock"), NewMutex(s2, "test/lock"), NewMutex(s3, "test/lock")
+	if err := m1.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.TryLock(ctx); errors.Cause(err) != ErrLocked {
+		t.Fatalf("unexpected TryLock error %v", err)
+	}
+	if m2.Key() != "" {
+		t.Fatalf("waiting key %q not removed", m2.Key())
+	}
+
+	lockedC := make(chan error, 1)
+	go func() { lockedC <- m2.Lock(ctx) }()
+	select {
+	case err := <-lockedC:
+		t.Fatalf("locked while held by others: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// 之后的等待者不影响排在前面的等待者
+	locked3C := make(chan error, 1)
+	go func() { locked3C <- m3.Lock(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// 持有者的 session 过期后，等待者获得锁
+	etcd.ExpireLease(s1.Lease())
+	select {
+	case err := <-lockedC:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the lock")
+	}
+	select {
+	case <-m1.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("lost lock not reported")
+	}
+
+	if err := m2.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-m2.Done()
+	select {
+	case err := <-locked3C:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the lock")
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx := context.Background()
+
+	var sems []*Semaphore
+	for i := 0; i < 3; i++ {
+		s, err := NewSession(c, WithTTL(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		sems = append(sems, NewSemaphore(s, "test/sem", 2))
+	}
+
+	for _, sem := range sems[:2] {
+		if err := sem.TryLock(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sems[2].TryLock(ctx); errors.Cause(err) != ErrLocked {
+		t.Fatalf("unexpected TryLock error %v", err)
+	}
+
+	lockedC := make(chan error, 1)
+	go func() { lockedC <- sems[2].Lock(ctx) }()
+	if err := sems[0].Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-lockedC:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the permit")
+	}
+}
+
+func TestMutexUnlockWaiting(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx := context.Background()
+
+	s1, err := NewSession(c, WithTTL(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2, err := NewSession(c, WithTTL(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	m1, m2 := NewMutex(s1, "test/lock"), NewMutex(s2, "test/lock")
+	if err := m1.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lockedC := make(chan error, 1)
+	go func() { lockedC <- m2.Lock(ctx) }()
+	deadline := time.Now().Add(3 * time.Second)
+	for m2.Key() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("not waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 等待期间不阻塞 Done，Unlock 放弃等待
+	if m2.Done() != nil {
+		t.Fatal("Done not nil while waiting")
+	}
+	if err := m2.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-lockedC:
+		if err == nil {
+			t.Fatal("locked after Unlock")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Lock still waiting after Unlock")
+	}
+	if m2.Key() != "" {
+		t.Fatalf("waiting key %q not removed", m2.Key())
+	}
+	if _, ok, err := s1.Get(ctx, m1.Key()); err != nil || !ok {
+		t.Fatalf("lock of m1 lost: %v", err)
+	}
+}
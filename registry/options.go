@@ -0,0 +1,134 @@
+package registry
+
+import (
+	"time"
+
+	"github.com/molon/pkg/server/health"
+)
+
+// Metadata is published as the Metadata of the registered address, in the
+// format clientstore.ParseMetadata decodes.
+type Metadata struct {
+	// Weight is the relative share of traffic, 1 by default.
+	Weight   int               `json:"weight"`
+	Version  string            `json:"version,omitempty"`
+	Zone     string            `json:"zone,omitempty"`
+	Protocol string            `json:"protocol,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	// Draining is set by Register.Drain, clientstore does not route new
+	// requests to the draining instances.
+	Draining bool `json:"draining,omitempty"`
+}
+
+func (md *Metadata) clone() *Metadata {
+	if md == nil {
+		return nil
+	}
+	c := *md
+	if md.Tags != nil {
+		c.Tags = make(map[string]string, len(md.Tags))
+		for k, v := range md.Tags {
+			c.Tags[k] = v
+		}
+	}
+	return &c
+}
+
+type registerOptions struct {
+	md *Metadata
+
+	readiness         health.Check
+	readinessInterval time.Duration
+	rise, fall        int
+}
+
+const (
+	defaultReadinessInterval = 3 * time.Second
+	defaultReadinessRise     = 2
+	defaultReadinessFall     = 3
+)
+
+// RegisterOption configures Register.
+type RegisterOption func(*registerOptions)
+
+// metadata 在首次设置时创建，未设置任何元数据时不发布 Metadata
+func (o *registerOptions) metadata() *Metadata {
+	if o.md == nil {
+		o.md = &Metadata{Weight: 1}
+	}
+	return o.md
+}
+
+// WithVersion publishes the build version of the instance.
+func WithVersion(version string) RegisterOption {
+	return func(options *registerOptions) {
+		options.metadata().Version = version
+	}
+}
+
+// WithWeight publishes the relative share of traffic of the instance.
+// If weight < 0, 0 will be used.
+func WithWeight(weight int) RegisterOption {
+	return func(options *registerOptions) {
+		if weight < 0 {
+			weight = 0
+		}
+		options.metadata().Weight = weight
+	}
+}
+
+// WithZone publishes the zone the instance runs in.
+func WithZone(zone string) RegisterOption {
+	return func(options *registerOptions) {
+		options.metadata().Zone = zone
+	}
+}
+
+// WithProtocol publishes the protocol the instance serves, e.g. "grpc".
+func WithProtocol(protocol string) RegisterOption {
+	return func(options *registerOptions) {
+		options.metadata().Protocol = protocol
+	}
+}
+
+// WithTag publishes an arbitrary tag of the instance.
+func WithTag(key, value string) RegisterOption {
+	return func(options *registerOptions) {
+		md := options.metadata()
+		if md.Tags == nil {
+			md.Tags = make(map[string]string)
+		}
+		md.Tags[key] = value
+	}
+}
+
+// WithTags publishes arbitrary tags of the instance.
+func WithTags(tags map[string]string) RegisterOption {
+	return func(options *registerOptions) {
+		for k, v := range tags {
+			WithTag(k, v)(options)
+		}
+	}
+}
+
+// WithReadiness publishes the key only while check passes, polling it every
+// interval (3 seconds if <= 0). While it fails, the key is withdrawn but the
+// lease is kept, so the instance reappears as soon as it is ready again.
+// Use health.ReadinessCheck to gate on the readiness set of a
+// checker, which must then not contain Register.Check itself.
+func WithReadiness(check health.Check, interval time.Duration) RegisterOption {
+	return func(options *registerOptions) {
+		options.readiness = check
+		options.readinessInterval = interval
+	}
+}
+
+// WithReadinessThresholds sets how many consecutive passes of the readiness
+// check publish the key (2 by default), and how many consecutive failures
+// withdraw it (3 by default), to avoid flapping.
+func WithReadinessThresholds(rise, fall int) RegisterOption {
+	return func(options *registerOptions) {
+		options.rise = rise
+		options.fall = fall
+	}
+}
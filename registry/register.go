@@ -2,70 +2,310 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/clientv3/naming"
 	"github.com/molon/pkg/errors"
 	"github.com/molon/pkg/plog"
 	"golang.org/x/time/rate"
-	gnaming "google.golang.org/grpc/naming"
 )
 
 const registerRetryRate = 1
 
+const opAdd = 0
+
+// update 是写入 "<prefix>/<addr>" 的值，与 etcd naming.GRPCResolver 写入的格式保持一致
+type update struct {
+	Op       uint8
+	Addr     string
+	Metadata interface{} `json:",omitempty"`
+}
+
+// Endpoint is an address registered under a prefix by NewMultiRegister.
+type Endpoint struct {
+	Prefix string
+	Addr   string
+	// Options are applied after the shared ones given to NewMultiRegister,
+	// e.g. WithProtocol. Only the options of the metadata take effect.
+	Options []RegisterOption
+}
+
+type endpoint struct {
+	prefix string
+	addr   string
+	md     *Metadata
+}
+
+func (ep *endpoint) key() string { return ep.prefix + "/" + ep.addr }
+
 type Register struct {
 	doneC chan struct{}
 
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	c   *clientv3.Client
+	ttl int
+
+	// 串行化对 etcd 的写入，期间不持有 mu，以免读取元数据等也要等待 etcd
+	writeMu sync.Mutex
+	// 保护以下字段，修改时须同时持有 writeMu 和 mu，读取只需持有其一
+	mu sync.Mutex
+	// 至少有一个，NewRegister 时只有一个
+	eps []*endpoint
+	// 当前有效的session，重新注册期间为nil
+	ss *Session
+	// 就绪检查是否通过，未设置就绪检查时总是true
+	ready bool
+	// key 是否已在当前session下发布
+	published bool
+	// 绑定到session的其他key，重新注册后需要重建
+	kvs map[string]string
+
+	status *statusHub
 }
 
-func registerSession(c *clientv3.Client, prefix string, addr string, ttl int) (*Session, error) {
-	ss, err := NewSession(c, WithTTL(ttl), WithContext(c.Ctx()))
+func (r *Register) registerSession(ttl int) (*Session, error) {
+	ss, err := NewSession(r.c, WithTTL(ttl), WithContext(r.c.Ctx()))
 	if err != nil {
 		return nil, err
 	}
 
-	gr := &naming.GRPCResolver{Client: c}
-	if err = gr.Update(c.Ctx(), prefix, gnaming.Update{Op: gnaming.Add, Addr: addr}, clientv3.WithLease(ss.Lease())); err != nil {
-		return nil, errors.WithStack(err)
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.setSessionLocked(ss)
+	err = r.sync()
+	for key, val := range r.kvs {
+		if err != nil {
+			break
+		}
+		err = r.putKey(r.c.Ctx(), ss, key, val)
+	}
+	if err != nil {
+		r.setSessionLocked(nil)
+		ss.Close()
+		return nil, err
 	}
 
-	plog.Infof("Registered \"%s/%s\" with %d-second lease", prefix, addr, ttl)
+	if r.published {
+		plog.Infof("Registered %s with %d-second lease", r.name(), ttl)
+	} else {
+		plog.Infof("Session of %s created with %d-second lease, waiting for readiness", r.name(), ttl)
+	}
 	return ss, nil
 }
 
-func NewRegister(c *clientv3.Client, prefix string, addr string, ttl int) *Register {
+// opCtx 限制单次 etcd 操作的时间，超过 ttl 时 lease 也已经过期了
+func (r *Register) opCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(r.ttl)*time.Second)
+}
+
+// sync 根据是否就绪发布或撤回 key，并更新状态，须持有 r.writeMu
+func (r *Register) sync() error {
+	if r.ss == nil {
+		return nil
+	}
+	switch {
+	case r.ready && !r.published:
+		if err := r.put(r.ss, r.eps...); err != nil {
+			return err
+		}
+		r.setPublished(true)
+	case !r.ready && r.published:
+		ops := make([]clientv3.Op, len(r.eps))
+		for i, ep := range r.eps {
+			ops[i] = clientv3.OpDelete(ep.key())
+		}
+		ctx, cancel := r.opCtx(r.c.Ctx())
+		defer cancel()
+		if _, err := r.c.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return errors.WithStack(err)
+		}
+		r.setPublished(false)
+	}
+
+	if r.published {
+		r.status.set(Registered, nil, r.ss.Lease())
+	} else {
+		r.status.set(Withdrawn, nil, r.ss.Lease())
+	}
+	return nil
+}
+
+// gate 定期执行就绪检查，连续 rise 次通过则发布，连续 fall 次失败则撤回
+func (r *Register) gate(ctx context.Context, opts *registerOptions) {
+	interval, rise, fall := opts.readinessInterval, opts.rise, opts.fall
+	if interval <= 0 {
+		interval = defaultReadinessInterval
+	}
+	if rise <= 0 {
+		rise = defaultReadinessRise
+	}
+	if fall <= 0 {
+		fall = defaultReadinessFall
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	passes, failures := 0, 0
+	for {
+		err := opts.readiness()
+		if err == nil {
+			passes, failures = passes+1, 0
+		} else {
+			passes, failures = 0, failures+1
+		}
+
+		r.writeMu.Lock()
+		switch {
+		case !r.ready && passes >= rise:
+			r.setReady(true)
+			plog.Infof("Readiness of %s passed, publishing", r.name())
+		case r.ready && failures >= fall:
+			r.setReady(false)
+			plog.Warnf("Readiness of %s failed, withdrawing: %v", r.name(), err)
+		}
+		if err := r.sync(); err != nil {
+			plog.Warnf("Sync registration of %s: %v", r.name(), err)
+		}
+		r.writeMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// put 在一个事务中写入 eps，须持有 r.writeMu
+func (r *Register) put(ss *Session, eps ...*endpoint) error {
+	ops := make([]clientv3.Op, len(eps))
+	for i, ep := range eps {
+		u := &update{Op: opAdd, Addr: ep.addr}
+		if ep.md != nil {
+			u.Metadata = ep.md
+		}
+		v, err := json.Marshal(u)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		ops[i] = clientv3.OpPut(ep.key(), string(v), clientv3.WithLease(ss.Lease()))
+	}
+	ctx, cancel := r.opCtx(r.c.Ctx())
+	defer cancel()
+	if _, err := r.c.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// putKey 写入 Put 绑定到 session 的 key
+func (r *Register) putKey(ctx context.Context, ss *Session, key, val string) error {
+	ctx, cancel := r.opCtx(ctx)
+	defer cancel()
+	return ss.Put(ctx, key, val)
+}
+
+// name 用于日志
+func (r *Register) name() string {
+	keys := make([]string, len(r.eps))
+	for i, ep := range r.eps {
+		keys[i] = fmt.Sprintf("%q", ep.key())
+	}
+	return strings.Join(keys, ", ")
+}
+
+// NewRegister keeps addr registered under prefix with a lease of ttl seconds,
+// re-registering whenever the session is lost, until Close.
+func NewRegister(c *clientv3.Client, prefix string, addr string, ttl int, opts ...RegisterOption) *Register {
+	return NewMultiRegister(c, []Endpoint{{Prefix: prefix, Addr: addr}}, ttl, opts...)
+}
+
+// NewMultiRegister is like NewRegister, but registers all the endpoints
+// under a single lease, e.g. the gRPC and HTTP addresses of a process, or
+// several services it serves. They are published and withdrawn in one
+// transaction, so they appear and disappear together. The methods on the
+// metadata apply to all the endpoints, unless noted otherwise.
+// It panics if endpoints is empty.
+func NewMultiRegister(c *clientv3.Client, endpoints []Endpoint, ttl int, opts ...RegisterOption) *Register {
+	if len(endpoints) == 0 {
+		panic("registry: no endpoints to register")
+	}
+	rOpts := &registerOptions{}
+	for _, opt := range opts {
+		opt(rOpts)
+	}
+
+	eps := make([]*endpoint, len(endpoints))
+	for i, e := range endpoints {
+		// 各自的元数据基于共享的元数据
+		epOpts := &registerOptions{md: rOpts.md.clone()}
+		for _, opt := range e.Options {
+			opt(epOpts)
+		}
+		eps[i] = &endpoint{prefix: e.Prefix, addr: e.Addr, md: epOpts.md}
+	}
+
 	doneC := make(chan struct{})
 	ctx, cancel := context.WithCancel(c.Ctx())
 	r := &Register{
 		doneC:  doneC,
 		ctx:    ctx,
 		cancel: cancel,
+		c:      c,
+		ttl:    ttl,
+		eps:    eps,
+		ready:  rOpts.readiness == nil,
+		kvs:    make(map[string]string),
+		status: newStatusHub(),
 	}
 
 	go func() {
 		defer close(doneC)
+		defer r.status.set(Closed, nil, clientv3.NoLease)
+
+		if rOpts.readiness != nil {
+			gateC := make(chan struct{})
+			go func() {
+				defer close(gateC)
+				r.gate(ctx, rOpts)
+			}()
+			defer func() { <-gateC }()
+		}
 
+		state := Registering
 		rm := rate.NewLimiter(rate.Limit(registerRetryRate), registerRetryRate)
 		for rm.Wait(ctx) == nil {
-			ss, err := registerSession(c, prefix, addr, ttl)
+			ss, err := r.registerSession(ttl)
 			if err != nil {
-				plog.Warnf("RegisterSession")
+				plog.Warnf("RegisterSession: %v", err)
+				r.status.set(state, err, clientv3.NoLease)
 				continue
 			}
 
 			select {
 			case <-ctx.Done():
+				r.setSession(nil)
 				err := ss.Close()
 				if err != nil {
-					plog.Warn("Ctx done, session close")
+					plog.Warnf("Ctx done, session close: %v", err)
 				}
 				return
 
 			case <-ss.Done():
+				r.setSession(nil)
+				r.status.set(SessionLost, nil, ss.Lease())
 				plog.Warn("Session expired; possible network partition or server restart")
 				plog.Warn("Creating a new session to rejoin")
+				state = Reregistering
+				r.status.set(state, nil, clientv3.NoLease)
 				continue
 			}
 		}
@@ -74,6 +314,209 @@ func NewRegister(c *clientv3.Client, prefix string, addr string, ttl int) *Regis
 	return r
 }
 
+func (r *Register) setSession(ss *Session) {
+	r.writeMu.Lock()
+	r.setSessionLocked(ss)
+	r.writeMu.Unlock()
+}
+
+// setSessionLocked 须持有 r.writeMu
+func (r *Register) setSessionLocked(ss *Session) {
+	r.mu.Lock()
+	r.ss = ss
+	r.published = false
+	r.mu.Unlock()
+}
+
+// setPublished 须持有 r.writeMu
+func (r *Register) setPublished(published bool) {
+	r.mu.Lock()
+	r.published = published
+	r.mu.Unlock()
+}
+
+// setReady 须持有 r.writeMu
+func (r *Register) setReady(ready bool) {
+	r.mu.Lock()
+	r.ready = ready
+	r.mu.Unlock()
+}
+
+// Metadata returns a copy of the published metadata of the first endpoint,
+// which is the only one of NewRegister, nil if none.
+func (r *Register) Metadata() *Metadata {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.eps[0].md.clone()
+}
+
+// EndpointMetadata returns a copy of the published metadata of the endpoint,
+// nil if none or the endpoint is not registered by r.
+func (r *Register) EndpointMetadata(prefix, addr string) *Metadata {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ep := r.endpoint(prefix, addr); ep != nil {
+		return ep.md.clone()
+	}
+	return nil
+}
+
+// UpdateMetadata replaces the published metadata, rewriting the registered
+// keys under the current lease. Draining is kept as is, it is only changed
+// by Drain and Undrain, and so is Weight if md.Weight is 0, use SetWeight to
+// change it to 0. If the Register is re-registering or
+// withdrawn, the new metadata is published once the keys are published again
+// and nil is returned. To update one of several endpoints, use
+// UpdateEndpointMetadata.
+func (r *Register) UpdateMetadata(md Metadata) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.updateMetadata(r.eps, replaceMetadata(md))
+}
+
+// UpdateEndpointMetadata is like UpdateMetadata, but only for the endpoint.
+func (r *Register) UpdateEndpointMetadata(prefix, addr string, md Metadata) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	ep := r.endpoint(prefix, addr)
+	if ep == nil {
+		return errors.Errorf("registry: endpoint \"%s/%s\" not registered", prefix, addr)
+	}
+	return r.updateMetadata([]*endpoint{ep}, replaceMetadata(md))
+}
+
+// replaceMetadata 替换为 md，但保留 Draining，它只由 Drain/Undrain 修改
+// md.Weight 为0时也保留原来的，以免只更新其他字段时意外地摘除了流量
+func replaceMetadata(md Metadata) func(*Metadata) *Metadata {
+	return func(old *Metadata) *Metadata {
+		cur := md.clone()
+		cur.Draining = old.Draining
+		if cur.Weight == 0 {
+			cur.Weight = old.Weight
+		}
+		return cur
+	}
+}
+
+// SetWeight sets the Weight of the published metadata. Weight 0 takes the
+// instance out of rotation whenever there are others with positive weights.
+func (r *Register) SetWeight(weight int) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.updateMetadata(r.eps, func(md *Metadata) *Metadata {
+		md.Weight = weight
+		return md
+	})
+}
+
+// Drain marks the instance as draining, so that clientstore stops routing
+// new requests to it, while keeping it registered.
+func (r *Register) Drain() error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.updateMetadata(r.eps, func(md *Metadata) *Metadata {
+		md.Draining = true
+		return md
+	})
+}
+
+// Undrain reverts Drain.
+func (r *Register) Undrain() error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.updateMetadata(r.eps, func(md *Metadata) *Metadata {
+		md.Draining = false
+		return md
+	})
+}
+
+// endpoint 只读取不变的 prefix 和 addr，无需持有锁
+func (r *Register) endpoint(prefix, addr string) *endpoint {
+	for _, ep := range r.eps {
+		if ep.prefix == prefix && ep.addr == addr {
+			return ep
+		}
+	}
+	return nil
+}
+
+// updateMetadata 须持有 r.writeMu
+func (r *Register) updateMetadata(eps []*endpoint, fn func(md *Metadata) *Metadata) error {
+	r.mu.Lock()
+	for _, ep := range eps {
+		md := ep.md.clone()
+		if md == nil {
+			md = &Metadata{Weight: 1}
+		}
+		ep.md = fn(md)
+	}
+	r.mu.Unlock()
+
+	if r.ss == nil || !r.published {
+		return nil
+	}
+	if err := r.put(r.ss, eps...); err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		plog.Infof("Updated metadata of %q", ep.key())
+	}
+	return nil
+}
+
+// Put puts key bound to the lease of the registration, and puts it again
+// whenever the Register re-registers, until Delete or Close. If the Register
+// is re-registering, the key is put once it has registered again and nil is
+// returned.
+func (r *Register) Put(ctx context.Context, key, val string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.mu.Lock()
+	r.kvs[key] = val
+	r.mu.Unlock()
+	if r.ss == nil {
+		return nil
+	}
+	return r.putKey(ctx, r.ss, key, val)
+}
+
+// Delete deletes the key put by Put.
+func (r *Register) Delete(ctx context.Context, key string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.mu.Lock()
+	delete(r.kvs, key)
+	r.mu.Unlock()
+	ctx, cancel := r.opCtx(ctx)
+	defer cancel()
+	_, err := r.c.Delete(ctx, key)
+	return errors.WithStack(err)
+}
+
+// State returns the current registration status.
+func (r *Register) State() RegisterStatus { return r.status.get() }
+
+// Subscribe returns a channel receiving the current status and then every
+// transition, and a func to cancel the subscription. The channel is closed
+// after Closed or the cancellation. A slow receiver may miss intermediate
+// transitions, but never the latest one.
+func (r *Register) Subscribe() (<-chan RegisterStatus, func()) { return r.status.subscribe() }
+
+// Check returns an error unless registered, its method value can be used as
+// a readiness check of server/health.
+func (r *Register) Check() error {
+	st := r.status.get()
+	if st.State == Registered {
+		return nil
+	}
+	if st.Err != nil {
+		return errors.Wrapf(st.Err, "registration %s", st.State)
+	}
+	return errors.Errorf("registration %s", st.State)
+}
+
 func (r *Register) Done() <-chan struct{} { return r.doneC }
 
 func (r *Register) Close() {
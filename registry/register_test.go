@@ -0,0 +1,319 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/molon/pkg/registry/registrytest"
+)
+
+func waitState(t *testing.T, ch <-chan RegisterStatus, want RegisterState, timeout time.Duration) RegisterStatus {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case st, ok := <-ch:
+			if !ok {
+				t.Fatalf("status closed waiting for %v", want)
+			}
+			if st.State == want {
+				return st
+			}
+		case <-deadline:
+			t.Fatalf("timeout waiting for %v", want)
+		}
+	}
+}
+
+func getUpdate(t *testing.T, c *v3.Client, key string) (*update, bool) {
+	t.Helper()
+	resp, err := c.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, false
+	}
+	u := &update{Metadata: &Metadata{}}
+	if err := json.Unmarshal(resp.Kvs[0].Value, u); err != nil {
+		t.Fatal(err)
+	}
+	return u, true
+}
+
+func TestRegisterReregister(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+
+	r := NewRegister(c, "test://svc", "127.0.0.1:8080", 10, WithVersion("v1"))
+	ch, cancel := r.Subscribe()
+	defer cancel()
+
+	st := waitState(t, ch, Registered, 3*time.Second)
+	if err := r.Put(context.Background(), "extra", "1"); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := getUpdate(t, c, "test://svc/127.0.0.1:8080")
+	if !ok || u.Addr != "127.0.0.1:8080" || u.Metadata.(*Metadata).Version != "v1" {
+		t.Fatalf("unexpected registration %+v", u)
+	}
+
+	if !etcd.ExpireLease(st.Lease) {
+		t.Fatalf("lease %x not found", st.Lease)
+	}
+	waitState(t, ch, SessionLost, 3*time.Second)
+	waitState(t, ch, Reregistering, time.Second)
+	st2 := waitState(t, ch, Registered, 3*time.Second)
+	if st2.Lease == st.Lease {
+		t.Fatalf("reregistered with the expired lease %x", st.Lease)
+	}
+	if _, ok := getUpdate(t, c, "test://svc/127.0.0.1:8080"); !ok {
+		t.Fatal("not registered again")
+	}
+	resp, err := c.Get(context.Background(), "extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || v3.LeaseID(resp.Kvs[0].Lease) != st2.Lease {
+		t.Fatalf("extra key not put again under the new lease: %v", resp.Kvs)
+	}
+
+	r.Close()
+	waitState(t, ch, Closed, time.Second)
+	if _, ok := getUpdate(t, c, "test://svc/127.0.0.1:8080"); ok {
+		t.Fatal("still registered after Close")
+	}
+	if leases := etcd.Leases(); len(leases) != 0 {
+		t.Fatalf("leases %v not revoked", leases)
+	}
+}
+
+func TestRegisterPartition(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	observer := etcd.NewClient()
+
+	r := NewRegister(c, "test://svc", "127.0.0.1:8080", 1)
+	defer r.Close()
+	ch, cancel := r.Subscribe()
+	defer cancel()
+	waitState(t, ch, Registered, 3*time.Second)
+
+	wch := observer.Watch(context.Background(), "test://svc/", v3.WithPrefix())
+	etcd.Partition(c)
+
+	// 分区期间 lease 过期，其他客户端看到注册被删除
+	select {
+	case wr := <-wch:
+		if len(wr.Events) != 1 || wr.Events[0].Type != v3.EventTypeDelete {
+			t.Fatalf("unexpected events %v", wr.Events)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the lease to expire")
+	}
+	waitState(t, ch, SessionLost, 3*time.Second)
+	if err := r.Check(); err == nil {
+		t.Fatal("Check passed while partitioned")
+	}
+
+	etcd.Heal(c)
+	waitState(t, ch, Registered, 5*time.Second)
+	select {
+	case wr := <-wch:
+		if len(wr.Events) != 1 || wr.Events[0].Type != v3.EventTypePut {
+			t.Fatalf("unexpected events %v", wr.Events)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for registering again")
+	}
+}
+
+func TestRegisterReadiness(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+
+	readyC := make(chan error, 1)
+	readyC <- nil
+	var last error
+	check := func() error {
+		select {
+		case last = <-readyC:
+		default:
+		}
+		return last
+	}
+	r := NewRegister(c, "test://svc", "127.0.0.1:8080", 10,
+		WithReadiness(check, 10*time.Millisecond), WithReadinessThresholds(1, 1))
+	defer r.Close()
+	ch, cancel := r.Subscribe()
+	defer cancel()
+
+	waitState(t, ch, Registered, 3*time.Second)
+	readyC <- context.DeadlineExceeded
+	waitState(t, ch, Withdrawn, time.Second)
+	if _, ok := getUpdate(t, c, "test://svc/127.0.0.1:8080"); ok {
+		t.Fatal("still registered after readiness failed")
+	}
+	readyC <- nil
+	waitState(t, ch, Registered, time.Second)
+}
+
+func TestRegisterUpdateMetadata(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+
+	r := NewRegister(c, "test://svc", "127.0.0.1:8080", 10, WithVersion("v1"))
+	defer r.Close()
+	ch, cancel := r.Subscribe()
+	defer cancel()
+	waitState(t, ch, Registered, 3*time.Second)
+
+	if err := r.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	// Draining 只由 Drain/Undrain 修改
+	if err := r.UpdateMetadata(Metadata{Weight: 3, Version: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := getUpdate(t, c, "test://svc/127.0.0.1:8080")
+	if !ok {
+		t.Fatal("not registered")
+	}
+	if md := u.Metadata.(*Metadata); md.Weight != 3 || md.Version != "v2" || !md.Draining {
+		t.Fatalf("unexpected registration %+v", md)
+	}
+
+	if err := r.Undrain(); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := getUpdate(t, c, "test://svc/127.0.0.1:8080"); !ok || u.Metadata.(*Metadata).Draining {
+		t.Fatal("still draining after Undrain")
+	}
+
+	// Weight 为0时保留原来的，只有 SetWeight 能设为0
+	if err := r.UpdateMetadata(Metadata{Version: "v3"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := getUpdate(t, c, "test://svc/127.0.0.1:8080"); !ok || u.Metadata.(*Metadata).Weight != 3 || u.Metadata.(*Metadata).Version != "v3" {
+		t.Fatalf("unexpected registration %+v", u)
+	}
+	if err := r.SetWeight(0); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := getUpdate(t, c, "test://svc/127.0.0.1:8080"); !ok || u.Metadata.(*Metadata).Weight != 0 || u.Metadata.(*Metadata).Version != "v3" {
+		t.Fatalf("unexpected registration %+v", u)
+	}
+}
+
+func TestMultiRegister(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+	ctx, cancelWatch := context.WithCancel(context.Background())
+	defer cancelWatch()
+
+	wch := c.Watch(ctx, "test://", v3.WithPrefix())
+	r := NewMultiRegister(c, []Endpoint{
+		{Prefix: "test://svc", Addr: "127.0.0.1:8080", Options: []RegisterOption{WithProtocol("grpc")}},
+		{Prefix: "test://svc-http", Addr: "127.0.0.1:8081", Options: []RegisterOption{WithProtocol("http")}},
+	}, 10, WithVersion("v1"))
+	defer r.Close()
+	ch, cancel := r.Subscribe()
+	defer cancel()
+	st := waitState(t, ch, Registered, 3*time.Second)
+
+	// 所有 endpoint 在同一个事务中发布，绑定同一个 lease
+	nextEvents := func(typ mvccpb.Event_EventType) []*v3.Event {
+		t.Helper()
+		select {
+		case wr := <-wch:
+			if len(wr.Events) != 2 || wr.Events[0].Type != typ || wr.Events[1].Type != typ {
+				t.Fatalf("unexpected events %v", wr.Events)
+			}
+			return wr.Events
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for %v", typ)
+		}
+		return nil
+	}
+	for _, ev := range nextEvents(mvccpb.PUT) {
+		if v3.LeaseID(ev.Kv.Lease) != st.Lease {
+			t.Fatalf("%q not under lease %x", ev.Kv.Key, st.Lease)
+		}
+	}
+	for key, protocol := range map[string]string{"test://svc/127.0.0.1:8080": "grpc", "test://svc-http/127.0.0.1:8081": "http"} {
+		u, ok := getUpdate(t, c, key)
+		if !ok {
+			t.Fatalf("%q not registered", key)
+		}
+		if md := u.Metadata.(*Metadata); md.Protocol != protocol || md.Version != "v1" {
+			t.Fatalf("unexpected registration of %q: %+v", key, u)
+		}
+	}
+
+	if err := r.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	nextEvents(mvccpb.PUT)
+	if err := r.UpdateEndpointMetadata("test://svc-http", "127.0.0.1:8081", Metadata{Weight: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// 更新 metadata 不会取消 Drain
+	if md := r.EndpointMetadata("test://svc-http", "127.0.0.1:8081"); md.Weight != 2 || !md.Draining {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+	if md := r.Metadata(); !md.Draining || md.Protocol != "grpc" {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+	if err := r.UpdateEndpointMetadata("test://svc", "127.0.0.1:9090", Metadata{}); err == nil {
+		t.Fatal("updated an unknown endpoint")
+	}
+	<-wch
+
+	etcd.ExpireLease(st.Lease)
+	nextEvents(mvccpb.DELETE)
+	waitState(t, ch, Registered, 3*time.Second)
+	nextEvents(mvccpb.PUT)
+}
+
+func TestRegisterPartitioned(t *testing.T) {
+	etcd := registrytest.NewEtcd()
+	defer etcd.Close()
+	c := etcd.NewClient()
+
+	r := NewRegister(c, "test://svc", "127.0.0.1:8080", 1, WithVersion("v1"))
+	defer r.Close()
+	ch, cancel := r.Subscribe()
+	defer cancel()
+	waitState(t, ch, Registered, 3*time.Second)
+
+	// etcd 不可达时写入受 ttl 限制，读取元数据不等待写入
+	etcd.Partition(c)
+	defer etcd.Heal(c)
+	errC := make(chan error, 1)
+	go func() { errC <- r.UpdateMetadata(Metadata{Version: "v2"}) }()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	if md := r.Metadata(); md == nil || md.Version == "" {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Metadata took %v", d)
+	}
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Fatal("updated while partitioned")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("UpdateMetadata not bounded by ttl")
+	}
+}
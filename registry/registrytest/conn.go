@@ -0,0 +1,160 @@
+package registrytest
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var errPartitioned = status.Error(codes.Unavailable, "registrytest: partitioned")
+
+// conn 是一个客户端到 Etcd 的连接，实现 KV、Lease 和 Watch 的 pb 客户端
+type conn struct {
+	e *Etcd
+
+	mu sync.Mutex
+	// 分区期间非nil，Heal 时关闭
+	healC chan struct{}
+	// 分区开始时关闭并替换，使之前建立的 watch stream 断开
+	breakC chan struct{}
+}
+
+func (cn *conn) partition() {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.healC == nil {
+		cn.healC = make(chan struct{})
+		if cn.breakC != nil {
+			close(cn.breakC)
+		}
+		cn.breakC = make(chan struct{})
+	}
+}
+
+func (cn *conn) heal() {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.healC != nil {
+		close(cn.healC)
+		cn.healC = nil
+	}
+}
+
+// healed 返回分区结束时关闭的 chan，未分区时返回nil
+func (cn *conn) healed() <-chan struct{} {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.healC
+}
+
+// broken 返回下次分区开始时关闭的 chan
+func (cn *conn) broken() <-chan struct{} {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.breakC == nil {
+		cn.breakC = make(chan struct{})
+	}
+	return cn.breakC
+}
+
+// check 在请求前检查 ctx 和分区
+func (cn *conn) check(ctx context.Context) error {
+	if err := ctxErr(ctx); err != nil {
+		return err
+	}
+	if cn.healed() != nil {
+		return errPartitioned
+	}
+	return nil
+}
+
+// ctxErr 转为 grpc 的错误，与经过网络的请求一致
+func ctxErr(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	default:
+		return status.Error(codes.Canceled, ctx.Err().Error())
+	}
+}
+
+// queue 是无界的消息队列，使 Etcd 在持有锁时推送消息不会阻塞
+type queue struct {
+	mu    sync.Mutex
+	items []interface{}
+	c     chan struct{}
+}
+
+func newQueue() *queue {
+	return &queue{c: make(chan struct{}, 1)}
+}
+
+func (q *queue) push(v interface{}) {
+	q.mu.Lock()
+	q.items = append(q.items, v)
+	q.mu.Unlock()
+
+	select {
+	case q.c <- struct{}{}:
+	default:
+	}
+}
+
+// pop 阻塞直到有消息且连接未分区，或 ctx 结束，或 brokenC 关闭
+func (q *queue) pop(ctx context.Context, cn *conn, brokenC <-chan struct{}) (interface{}, error) {
+	for {
+		if healC := cn.healed(); healC != nil {
+			select {
+			case <-healC:
+			case <-brokenC:
+				return nil, errPartitioned
+			case <-ctx.Done():
+				return nil, ctxErr(ctx)
+			}
+		}
+
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			v := q.items[0]
+			q.items[0] = nil
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return v, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.c:
+		case <-brokenC:
+			return nil, errPartitioned
+		case <-ctx.Done():
+			return nil, ctxErr(ctx)
+		}
+	}
+}
+
+// clientStream 实现 grpc.ClientStream 中与消息无关的部分
+type clientStream struct {
+	ctx context.Context
+}
+
+var _ grpc.ClientStream = (*clientStream)(nil)
+
+func (s *clientStream) Header() (metadata.MD, error) { return metadata.MD{}, nil }
+func (s *clientStream) Trailer() metadata.MD         { return metadata.MD{} }
+func (s *clientStream) CloseSend() error             { return nil }
+func (s *clientStream) Context() context.Context     { return s.ctx }
+
+func (s *clientStream) SendMsg(m interface{}) error {
+	return status.Error(codes.Unimplemented, "registrytest: SendMsg")
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	return status.Error(codes.Unimplemented, "registrytest: RecvMsg")
+}
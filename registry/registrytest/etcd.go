@@ -0,0 +1,348 @@
+// Package registrytest provides an in-memory etcd for testing the code built
+// on registry and clientstore without running etcd.
+package registrytest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// expireInterval is how often the expired leases are revoked, like the
+// lessor of etcd does every 500ms.
+const expireInterval = 100 * time.Millisecond
+
+// keepAliveTimeout is how long the lease client of the fake clients waits for
+// the first keepalive response.
+const keepAliveTimeout = 5 * time.Second
+
+// Etcd is an in-memory etcd of a single member. It implements the KV, Lease
+// and Watch APIs with the semantics of etcd v3 that registry and clientstore
+// rely on: revisions, leases with keepalive and expiry, watches from a
+// revision with prev kv, and compaction.
+//
+// Besides the real expiry by TTL, tests can expire a lease at once with
+// ExpireLease, or cut a client off with Partition to make its session expire
+// as in a network partition.
+type Etcd struct {
+	mu sync.Mutex
+
+	rev        int64
+	compactRev int64
+	kvs        map[string]*mvccpb.KeyValue
+	// compactRev 之后的全部事件，按 revision 排序，PrevKv 总是记录
+	history []*mvccpb.Event
+
+	leases      map[int64]*lease
+	nextLeaseID int64
+
+	watchers   map[*watcher]struct{}
+	keepAlives map[*keepAliveStream]struct{}
+
+	conns map[*v3.Client]*conn
+
+	stopC chan struct{}
+	doneC chan struct{}
+}
+
+type lease struct {
+	id     int64
+	ttl    int64
+	expiry time.Time
+	keys   map[string]struct{}
+}
+
+// NewEtcd starts an empty Etcd at revision 1. Close it to stop the expiry
+// loop and close the clients.
+func NewEtcd() *Etcd {
+	e := &Etcd{
+		rev:         1,
+		kvs:         make(map[string]*mvccpb.KeyValue),
+		leases:      make(map[int64]*lease),
+		nextLeaseID: 0x1000,
+		watchers:    make(map[*watcher]struct{}),
+		keepAlives:  make(map[*keepAliveStream]struct{}),
+		conns:       make(map[*v3.Client]*conn),
+		stopC:       make(chan struct{}),
+		doneC:       make(chan struct{}),
+	}
+	go e.expireLoop()
+	return e
+}
+
+// NewClient returns a client connected to e. It is closed by Close of e if
+// not closed before.
+func (e *Etcd) NewClient() *v3.Client {
+	c := v3.NewCtxClient(context.Background())
+	cn := &conn{e: e}
+	c.KV = v3.NewKVFromKVClient(cn, c)
+	c.Lease = v3.NewLeaseFromLeaseClient(cn, c, keepAliveTimeout)
+	c.Watcher = v3.NewWatchFromWatchClient(cn, c)
+
+	e.mu.Lock()
+	e.conns[c] = cn
+	e.mu.Unlock()
+	return c
+}
+
+// Partition cuts c off from e until Heal: its requests fail with
+// codes.Unavailable, its keepalives are dropped so its leases expire by TTL,
+// and its watch streams break, so the watches resumed by the client receive
+// nothing until Heal.
+func (e *Etcd) Partition(c *v3.Client) {
+	if cn := e.conn(c); cn != nil {
+		cn.partition()
+	}
+}
+
+// Heal reconnects c cut off by Partition. Its watches receive what they have
+// missed since the revision they resumed from, or ErrCompacted if it has been
+// compacted meanwhile.
+func (e *Etcd) Heal(c *v3.Client) {
+	if cn := e.conn(c); cn != nil {
+		cn.heal()
+	}
+}
+
+func (e *Etcd) conn(c *v3.Client) *conn {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.conns[c]
+}
+
+// ExpireLease expires the lease at once as if its TTL elapsed, deleting its
+// keys. The clients keeping it alive are told it is gone immediately, instead
+// of at their next keepalive. It returns false if the lease does not exist.
+func (e *Etcd) ExpireLease(id v3.LeaseID) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.revoke(int64(id))
+}
+
+// ExpireAll expires all leases, e.g. to simulate etcd restored from a
+// snapshot taken before the leases were granted.
+func (e *Etcd) ExpireAll() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id := range e.leases {
+		e.revoke(id)
+	}
+}
+
+// Leases returns the IDs of the live leases in ascending order.
+func (e *Etcd) Leases() []v3.LeaseID {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids := make([]v3.LeaseID, 0, len(e.leases))
+	for id := range e.leases {
+		ids = append(ids, v3.LeaseID(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Revision returns the current revision.
+func (e *Etcd) Revision() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rev
+}
+
+// Close stops the expiry loop and closes the clients returned by NewClient.
+func (e *Etcd) Close() {
+	select {
+	case <-e.stopC:
+		return
+	default:
+	}
+	close(e.stopC)
+	<-e.doneC
+
+	e.mu.Lock()
+	clients := make([]*v3.Client, 0, len(e.conns))
+	for c := range e.conns {
+		clients = append(clients, c)
+	}
+	e.conns = make(map[*v3.Client]*conn)
+	e.mu.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func (e *Etcd) expireLoop() {
+	defer close(e.doneC)
+
+	t := time.NewTicker(expireInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.stopC:
+			return
+		case now := <-t.C:
+			e.mu.Lock()
+			for id, l := range e.leases {
+				if l.expiry.Before(now) {
+					e.revoke(id)
+				}
+			}
+			e.mu.Unlock()
+		}
+	}
+}
+
+// revoke 删除 lease 及其 key，并通知 keepalive 的客户端，须持有 e.mu
+func (e *Etcd) revoke(id int64) bool {
+	l, ok := e.leases[id]
+	if !ok {
+		return false
+	}
+	delete(e.leases, id)
+
+	w := e.begin()
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		w.delete(key)
+	}
+	w.commit()
+
+	for ka := range e.keepAlives {
+		if ka.sent(id) {
+			ka.push(&pb.LeaseKeepAliveResponse{Header: e.header(), ID: id})
+		}
+	}
+	return true
+}
+
+func (e *Etcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{ClusterId: 1, MemberId: 1, Revision: e.rev, RaftTerm: 1}
+}
+
+// write 是一次事务内的写入，所有写入使用同一个 revision
+type write struct {
+	e      *Etcd
+	rev    int64
+	events []*mvccpb.Event
+}
+
+// begin 开始写入，须持有 e.mu
+func (e *Etcd) begin() *write {
+	return &write{e: e, rev: e.rev + 1}
+}
+
+func (w *write) put(key string, val []byte, leaseID int64) *mvccpb.KeyValue {
+	e := w.e
+	prev := e.kvs[key]
+	kv := &mvccpb.KeyValue{
+		Key:            []byte(key),
+		Value:          val,
+		CreateRevision: w.rev,
+		ModRevision:    w.rev,
+		Version:        1,
+		Lease:          leaseID,
+	}
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+		if l, ok := e.leases[prev.Lease]; ok {
+			delete(l.keys, key)
+		}
+	}
+	if l, ok := e.leases[leaseID]; ok {
+		l.keys[key] = struct{}{}
+	}
+	e.kvs[key] = kv
+	w.events = append(w.events, &mvccpb.Event{Type: mvccpb.PUT, Kv: kv, PrevKv: prev})
+	return prev
+}
+
+func (w *write) delete(key string) *mvccpb.KeyValue {
+	e := w.e
+	prev, ok := e.kvs[key]
+	if !ok {
+		return nil
+	}
+	if l, ok := e.leases[prev.Lease]; ok {
+		delete(l.keys, key)
+	}
+	delete(e.kvs, key)
+	w.events = append(w.events, &mvccpb.Event{
+		Type:   mvccpb.DELETE,
+		Kv:     &mvccpb.KeyValue{Key: []byte(key), ModRevision: w.rev},
+		PrevKv: prev,
+	})
+	return prev
+}
+
+// commit 有写入时递增 revision 并通知 watcher
+func (w *write) commit() {
+	if len(w.events) == 0 {
+		return
+	}
+	e := w.e
+	e.rev = w.rev
+	e.history = append(e.history, w.events...)
+	for wt := range e.watchers {
+		wt.notify(e.header(), w.events)
+	}
+}
+
+// kvsAt 返回 rev 时的全部 kv，rev 须在 (compactRev, e.rev] 之间
+func (e *Etcd) kvsAt(rev int64) map[string]*mvccpb.KeyValue {
+	if rev >= e.rev {
+		return e.kvs
+	}
+	kvs := make(map[string]*mvccpb.KeyValue, len(e.kvs))
+	for k, kv := range e.kvs {
+		kvs[k] = kv
+	}
+	for i := len(e.history) - 1; i >= 0 && e.history[i].Kv.ModRevision > rev; i-- {
+		ev := e.history[i]
+		if ev.PrevKv == nil {
+			delete(kvs, string(ev.Kv.Key))
+		} else {
+			kvs[string(ev.Kv.Key)] = ev.PrevKv
+		}
+	}
+	return kvs
+}
+
+// inRange 与 etcd 一致：end 为空时只匹配 key，为 "\x00" 时匹配不小于 key 的全部
+func inRange(key, start, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return string(key) == string(start)
+	case len(end) == 1 && end[0] == 0:
+		return string(key) >= string(start)
+	default:
+		return string(key) >= string(start) && string(key) < string(end)
+	}
+}
+
+// rangeKeys 返回范围内按 key 排序的 kv
+func rangeKeys(kvs map[string]*mvccpb.KeyValue, start, end []byte) []*mvccpb.KeyValue {
+	var ret []*mvccpb.KeyValue
+	if len(end) == 0 {
+		if kv, ok := kvs[string(start)]; ok {
+			ret = append(ret, kv)
+		}
+		return ret
+	}
+	for k, kv := range kvs {
+		if inRange([]byte(k), start, end) {
+			ret = append(ret, kv)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return string(ret[i].Key) < string(ret[j].Key) })
+	return ret
+}
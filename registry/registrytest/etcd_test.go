@@ -0,0 +1,139 @@
+package registrytest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestKV(t *testing.T) {
+	e := NewEtcd()
+	defer e.Close()
+	c := e.NewClient()
+	ctx := context.Background()
+
+	for _, k := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		if _, err := c.Put(ctx, k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := c.Get(ctx, "a/", v3.WithPrefix(), v3.WithMaxCreateRev(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Count 与 etcd 一致，不受过滤影响
+	if len(resp.Kvs) != 2 || resp.Count != 3 {
+		t.Fatalf("unexpected range kvs %v count %d", resp.Kvs, resp.Count)
+	}
+	resp, err = c.Get(ctx, "a/", v3.WithLastCreate()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Key) != "a/3" || !resp.More {
+		t.Fatalf("unexpected last create %v", resp.Kvs)
+	}
+
+	tresp, err := c.Txn(ctx).
+		If(v3.Compare(v3.CreateRevision("a/4"), "=", 0)).
+		Then(v3.OpPut("a/4", "a/4"), v3.OpDelete("a/1")).
+		Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tresp.Succeeded || tresp.Header.Revision != 6 {
+		t.Fatalf("unexpected txn %+v", tresp)
+	}
+
+	resp, err = c.Get(ctx, "a/1", v3.WithRev(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatalf("a/1 not found at revision 5")
+	}
+	if _, err := c.Compact(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "a/1", v3.WithRev(4)); err != rpctypes.ErrCompacted {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	e := NewEtcd()
+	defer e.Close()
+	c := e.NewClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c.Put(ctx, "k", "1")
+	c.Put(ctx, "k", "2")
+	wch := c.Watch(ctx, "k", v3.WithRev(2), v3.WithPrevKV())
+	wr := <-wch
+	if len(wr.Events) != 2 || string(wr.Events[1].PrevKv.Value) != "1" {
+		t.Fatalf("unexpected events %v", wr.Events)
+	}
+	c.Delete(ctx, "k")
+	wr = <-wch
+	if len(wr.Events) != 1 || wr.Events[0].Type != v3.EventTypeDelete || wr.Header.Revision != 4 {
+		t.Fatalf("unexpected events %v", wr.Events)
+	}
+
+	c.Compact(ctx, 3)
+	wr = <-c.Watch(ctx, "k", v3.WithRev(2))
+	if wr.Err() != rpctypes.ErrCompacted || wr.CompactRevision != 3 {
+		t.Fatalf("unexpected watch response %+v", wr)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	e := NewEtcd()
+	defer e.Close()
+	c := e.NewClient()
+	ctx := context.Background()
+
+	lresp, err := c.Grant(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put(ctx, "k", "v", v3.WithLease(lresp.ID))
+	kach, err := c.KeepAlive(ctx, lresp.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 续约期间不过期
+	time.Sleep(1500 * time.Millisecond)
+	if ttl, err := c.TimeToLive(ctx, lresp.ID, v3.WithAttachedKeys()); err != nil || ttl.TTL <= 0 || len(ttl.Keys) != 1 {
+		t.Fatalf("unexpected ttl %+v, err %v", ttl, err)
+	}
+
+	e.Partition(c)
+	if _, err := c.Get(ctx, "k"); status.Code(err) != codes.Unavailable {
+		t.Fatalf("unexpected error %v while partitioned", err)
+	}
+	deadline := time.After(3 * time.Second)
+	for len(e.Leases()) != 0 {
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for the lease to expire")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	e.Heal(c)
+
+	for range kach {
+	}
+	resp, err := c.Get(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 0 {
+		t.Fatal("key of the expired lease not deleted")
+	}
+}
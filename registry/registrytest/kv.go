@@ -0,0 +1,379 @@
+package registrytest
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+)
+
+var _ pb.KVClient = (*conn)(nil)
+
+func (cn *conn) Range(ctx context.Context, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	e := cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rangeKeys(in)
+}
+
+func (cn *conn) Put(ctx context.Context, in *pb.PutRequest, opts ...grpc.CallOption) (*pb.PutResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	e := cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w := e.begin()
+	resp, err := w.putReq(in)
+	if err != nil {
+		return nil, err
+	}
+	w.commit()
+	resp.Header = e.header()
+	return resp, nil
+}
+
+func (cn *conn) DeleteRange(ctx context.Context, in *pb.DeleteRangeRequest, opts ...grpc.CallOption) (*pb.DeleteRangeResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	e := cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w := e.begin()
+	resp := w.deleteReq(in)
+	w.commit()
+	resp.Header = e.header()
+	return resp, nil
+}
+
+func (cn *conn) Txn(ctx context.Context, in *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	e := cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w := e.begin()
+	resp, err := w.txnReq(in)
+	if err != nil {
+		// 与 etcd 一致，事务要么全部生效要么不生效；这里只在写入前校验失败，无需回滚
+		return nil, err
+	}
+	w.commit()
+	setHeaders(resp, e.header())
+	return resp, nil
+}
+
+func (cn *conn) Compact(ctx context.Context, in *pb.CompactionRequest, opts ...grpc.CallOption) (*pb.CompactionResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	e := cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case in.Revision <= e.compactRev:
+		return nil, rpctypes.ErrGRPCCompacted
+	case in.Revision > e.rev:
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
+	e.compactRev = in.Revision
+	i := sort.Search(len(e.history), func(i int) bool { return e.history[i].Kv.ModRevision > in.Revision })
+	e.history = append([]*mvccpb.Event(nil), e.history[i:]...)
+	return &pb.CompactionResponse{Header: e.header()}, nil
+}
+
+// rangeKeys 须持有 e.mu
+func (e *Etcd) rangeKeys(in *pb.RangeRequest) (*pb.RangeResponse, error) {
+	rev := in.Revision
+	switch {
+	case rev <= 0:
+		rev = e.rev
+	case rev <= e.compactRev:
+		return nil, rpctypes.ErrGRPCCompacted
+	case rev > e.rev:
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
+
+	kvs := rangeKeys(e.kvsAt(rev), in.Key, in.RangeEnd)
+	// 与 etcd 一致，Count 是过滤之前范围内的数量
+	resp := &pb.RangeResponse{Header: e.header(), Count: int64(len(kvs))}
+
+	kvs = pruneKVs(kvs, func(kv *mvccpb.KeyValue) bool {
+		return (in.MaxModRevision == 0 || kv.ModRevision <= in.MaxModRevision) &&
+			(in.MinModRevision == 0 || kv.ModRevision >= in.MinModRevision) &&
+			(in.MaxCreateRevision == 0 || kv.CreateRevision <= in.MaxCreateRevision) &&
+			(in.MinCreateRevision == 0 || kv.CreateRevision >= in.MinCreateRevision)
+	})
+
+	order := in.SortOrder
+	if order == pb.RangeRequest_NONE && in.SortTarget != pb.RangeRequest_KEY {
+		order = pb.RangeRequest_ASCEND
+	}
+	if order != pb.RangeRequest_NONE {
+		less := sortLess(in.SortTarget)
+		sort.SliceStable(kvs, func(i, j int) bool {
+			if order == pb.RangeRequest_DESCEND {
+				return less(kvs[j], kvs[i])
+			}
+			return less(kvs[i], kvs[j])
+		})
+	}
+
+	if in.Limit > 0 && int64(len(kvs)) > in.Limit {
+		kvs = kvs[:in.Limit]
+		resp.More = true
+	}
+	if in.CountOnly {
+		return resp, nil
+	}
+	resp.Kvs = make([]*mvccpb.KeyValue, len(kvs))
+	for i, kv := range kvs {
+		c := *kv
+		if in.KeysOnly {
+			c.Value = nil
+		}
+		resp.Kvs[i] = &c
+	}
+	return resp, nil
+}
+
+func pruneKVs(kvs []*mvccpb.KeyValue, keep func(*mvccpb.KeyValue) bool) []*mvccpb.KeyValue {
+	ret := kvs[:0:0]
+	for _, kv := range kvs {
+		if keep(kv) {
+			ret = append(ret, kv)
+		}
+	}
+	return ret
+}
+
+func sortLess(target pb.RangeRequest_SortTarget) func(a, b *mvccpb.KeyValue) bool {
+	switch target {
+	case pb.RangeRequest_VERSION:
+		return func(a, b *mvccpb.KeyValue) bool { return a.Version < b.Version }
+	case pb.RangeRequest_CREATE:
+		return func(a, b *mvccpb.KeyValue) bool { return a.CreateRevision < b.CreateRevision }
+	case pb.RangeRequest_MOD:
+		return func(a, b *mvccpb.KeyValue) bool { return a.ModRevision < b.ModRevision }
+	case pb.RangeRequest_VALUE:
+		return func(a, b *mvccpb.KeyValue) bool { return bytes.Compare(a.Value, b.Value) < 0 }
+	default:
+		return func(a, b *mvccpb.KeyValue) bool { return bytes.Compare(a.Key, b.Key) < 0 }
+	}
+}
+
+func (w *write) putReq(in *pb.PutRequest) (*pb.PutResponse, error) {
+	e := w.e
+	if len(in.Key) == 0 {
+		return nil, rpctypes.ErrGRPCEmptyKey
+	}
+	prev := e.kvs[string(in.Key)]
+	val, leaseID := in.Value, in.Lease
+	if in.IgnoreValue || in.IgnoreLease {
+		if prev == nil {
+			return nil, rpctypes.ErrGRPCKeyNotFound
+		}
+		if in.IgnoreValue {
+			val = prev.Value
+		}
+		if in.IgnoreLease {
+			leaseID = prev.Lease
+		}
+	}
+	if leaseID != 0 {
+		if _, ok := e.leases[leaseID]; !ok {
+			return nil, rpctypes.ErrGRPCLeaseNotFound
+		}
+	}
+
+	w.put(string(in.Key), val, leaseID)
+	resp := &pb.PutResponse{}
+	if in.PrevKv && prev != nil {
+		c := *prev
+		resp.PrevKv = &c
+	}
+	return resp, nil
+}
+
+func (w *write) deleteReq(in *pb.DeleteRangeRequest) *pb.DeleteRangeResponse {
+	resp := &pb.DeleteRangeResponse{}
+	for _, kv := range rangeKeys(w.e.kvs, in.Key, in.RangeEnd) {
+		prev := w.delete(string(kv.Key))
+		resp.Deleted++
+		if in.PrevKv {
+			c := *prev
+			resp.PrevKvs = append(resp.PrevKvs, &c)
+		}
+	}
+	return resp
+}
+
+func (w *write) txnReq(in *pb.TxnRequest) (*pb.TxnResponse, error) {
+	e := w.e
+	succeeded := true
+	for _, c := range in.Compare {
+		if !e.compare(c) {
+			succeeded = false
+			break
+		}
+	}
+	ops := in.Success
+	if !succeeded {
+		ops = in.Failure
+	}
+	// 先校验，保证失败时不产生部分写入
+	if err := e.checkOps(ops); err != nil {
+		return nil, err
+	}
+
+	resp := &pb.TxnResponse{Succeeded: succeeded, Responses: make([]*pb.ResponseOp, 0, len(ops))}
+	for _, op := range ops {
+		switch r := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			rr, err := e.rangeKeys(r.RequestRange)
+			if err != nil {
+				return nil, err
+			}
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: rr}})
+		case *pb.RequestOp_RequestPut:
+			pr, err := w.putReq(r.RequestPut)
+			if err != nil {
+				return nil, err
+			}
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{ResponsePut: pr}})
+		case *pb.RequestOp_RequestDeleteRange:
+			dr := w.deleteReq(r.RequestDeleteRange)
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: dr}})
+		case *pb.RequestOp_RequestTxn:
+			tr, err := w.txnReq(r.RequestTxn)
+			if err != nil {
+				return nil, err
+			}
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseTxn{ResponseTxn: tr}})
+		}
+	}
+	return resp, nil
+}
+
+// checkOps 校验会导致写入失败的请求，与 etcd 的 checkRequests 对应
+func (e *Etcd) checkOps(ops []*pb.RequestOp) error {
+	for _, op := range ops {
+		switch r := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			rev := r.RequestRange.Revision
+			if rev > e.rev {
+				return rpctypes.ErrGRPCFutureRev
+			}
+			if rev > 0 && rev <= e.compactRev {
+				return rpctypes.ErrGRPCCompacted
+			}
+		case *pb.RequestOp_RequestPut:
+			in := r.RequestPut
+			if len(in.Key) == 0 {
+				return rpctypes.ErrGRPCEmptyKey
+			}
+			if (in.IgnoreValue || in.IgnoreLease) && e.kvs[string(in.Key)] == nil {
+				return rpctypes.ErrGRPCKeyNotFound
+			}
+			if in.Lease != 0 && !in.IgnoreLease {
+				if _, ok := e.leases[in.Lease]; !ok {
+					return rpctypes.ErrGRPCLeaseNotFound
+				}
+			}
+		case *pb.RequestOp_RequestTxn:
+			// 嵌套事务的分支在执行时才能确定，与 etcd 一样两个分支都校验
+			if err := e.checkOps(r.RequestTxn.Success); err != nil {
+				return err
+			}
+			if err := e.checkOps(r.RequestTxn.Failure); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compare 与 etcd 一致：key 不存在时按零值比较，但比较 VALUE 总是失败
+func (e *Etcd) compare(c *pb.Compare) bool {
+	kvs := rangeKeys(e.kvs, c.Key, c.RangeEnd)
+	if len(kvs) == 0 {
+		if c.Target == pb.Compare_VALUE {
+			return false
+		}
+		return compareKV(c, &mvccpb.KeyValue{})
+	}
+	for _, kv := range kvs {
+		if !compareKV(c, kv) {
+			return false
+		}
+	}
+	return true
+}
+
+func compareKV(c *pb.Compare, kv *mvccpb.KeyValue) bool {
+	var r int
+	switch c.Target {
+	case pb.Compare_VALUE:
+		r = bytes.Compare(kv.Value, c.GetValue())
+	case pb.Compare_VERSION:
+		r = compareInt64(kv.Version, c.GetVersion())
+	case pb.Compare_CREATE:
+		r = compareInt64(kv.CreateRevision, c.GetCreateRevision())
+	case pb.Compare_MOD:
+		r = compareInt64(kv.ModRevision, c.GetModRevision())
+	case pb.Compare_LEASE:
+		r = compareInt64(kv.Lease, c.GetLease())
+	}
+	switch c.Result {
+	case pb.Compare_EQUAL:
+		return r == 0
+	case pb.Compare_NOT_EQUAL:
+		return r != 0
+	case pb.Compare_GREATER:
+		return r > 0
+	case pb.Compare_LESS:
+		return r < 0
+	}
+	return false
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// setHeaders 事务的响应及其内部的响应都使用提交后的 header
+func setHeaders(resp *pb.TxnResponse, h *pb.ResponseHeader) {
+	resp.Header = h
+	for _, r := range resp.Responses {
+		switch rr := r.Response.(type) {
+		case *pb.ResponseOp_ResponseRange:
+			rr.ResponseRange.Header = h
+		case *pb.ResponseOp_ResponsePut:
+			rr.ResponsePut.Header = h
+		case *pb.ResponseOp_ResponseDeleteRange:
+			rr.ResponseDeleteRange.Header = h
+		case *pb.ResponseOp_ResponseTxn:
+			setHeaders(rr.ResponseTxn, h)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package registrytest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+var _ pb.LeaseClient = (*conn)(nil)
+
+func (cn *conn) LeaseGrant(ctx context.Context, in *pb.LeaseGrantRequest, opts ...grpc.CallOption) (*pb.LeaseGrantResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	e := cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := in.ID
+	if id == 0 {
+		for {
+			e.nextLeaseID++
+			if _, ok := e.leases[e.nextLeaseID]; !ok {
+				break
+			}
+		}
+		id = e.nextLeaseID
+	} else if _, ok := e.leases[id]; ok {
+		return nil, rpctypes.ErrGRPCLeaseExist
+	}
+	ttl := in.TTL
+	if ttl <= 0 {
+		ttl = 1
+	}
+	e.leases[id] = &lease{
+		id:     id,
+		ttl:    ttl,
+		expiry: time.Now().Add(time.Duration(ttl) * time.Second),
+		keys:   make(map[string]struct{}),
+	}
+	return &pb.LeaseGrantResponse{Header: e.header(), ID: id, TTL: ttl}, nil
+}
+
+func (cn *conn) LeaseRevoke(ctx context.Context, in *pb.LeaseRevokeRequest, opts ...grpc.CallOption) (*pb.LeaseRevokeResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	e := cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.revoke(in.ID) {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	return &pb.LeaseRevokeResponse{Header: e.header()}, nil
+}
+
+func (cn *conn) LeaseTimeToLive(ctx context.Context, in *pb.LeaseTimeToLiveRequest, opts ...grpc.CallOption) (*pb.LeaseTimeToLiveResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	e := cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	l, ok := e.leases[in.ID]
+	if !ok {
+		// 与 etcd 一致，不存在的 lease 返回 TTL -1 而不是错误
+		return &pb.LeaseTimeToLiveResponse{Header: e.header(), ID: in.ID, TTL: -1}, nil
+	}
+	resp := &pb.LeaseTimeToLiveResponse{
+		Header:     e.header(),
+		ID:         l.id,
+		TTL:        int64((time.Until(l.expiry) + time.Second - 1) / time.Second),
+		GrantedTTL: l.ttl,
+	}
+	if in.Keys {
+		for key := range l.keys {
+			resp.Keys = append(resp.Keys, []byte(key))
+		}
+		sort.Slice(resp.Keys, func(i, j int) bool { return string(resp.Keys[i]) < string(resp.Keys[j]) })
+	}
+	return resp, nil
+}
+
+func (cn *conn) LeaseLeases(ctx context.Context, in *pb.LeaseLeasesRequest, opts ...grpc.CallOption) (*pb.LeaseLeasesResponse, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	resp := &pb.LeaseLeasesResponse{}
+	for _, id := range cn.e.Leases() {
+		resp.Leases = append(resp.Leases, &pb.LeaseStatus{ID: int64(id)})
+	}
+	cn.e.mu.Lock()
+	resp.Header = cn.e.header()
+	cn.e.mu.Unlock()
+	return resp, nil
+}
+
+func (cn *conn) LeaseKeepAlive(ctx context.Context, opts ...grpc.CallOption) (pb.Lease_LeaseKeepAliveClient, error) {
+	if err := cn.check(ctx); err != nil {
+		return nil, err
+	}
+	ka := &keepAliveStream{
+		clientStream: clientStream{ctx: ctx},
+		cn:           cn,
+		q:            newQueue(),
+		ids:          make(map[int64]struct{}),
+	}
+
+	e := cn.e
+	e.mu.Lock()
+	e.keepAlives[ka] = struct{}{}
+	e.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		e.mu.Lock()
+		delete(e.keepAlives, ka)
+		e.mu.Unlock()
+	}()
+	return ka, nil
+}
+
+type keepAliveStream struct {
+	clientStream
+	cn *conn
+	q  *queue
+
+	mu sync.Mutex
+	// 通过此 stream 续约过的 lease
+	ids map[int64]struct{}
+}
+
+func (ka *keepAliveStream) Send(req *pb.LeaseKeepAliveRequest) error {
+	if err := ctxErr(ka.ctx); err != nil {
+		return err
+	}
+	// 分区时丢弃，lease 会因为未续约而过期
+	if ka.cn.healed() != nil {
+		return nil
+	}
+
+	ka.mu.Lock()
+	ka.ids[req.ID] = struct{}{}
+	ka.mu.Unlock()
+
+	e := ka.cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	resp := &pb.LeaseKeepAliveResponse{Header: e.header(), ID: req.ID}
+	if l, ok := e.leases[req.ID]; ok {
+		l.expiry = time.Now().Add(time.Duration(l.ttl) * time.Second)
+		resp.TTL = l.ttl
+	}
+	ka.push(resp)
+	return nil
+}
+
+func (ka *keepAliveStream) Recv() (*pb.LeaseKeepAliveResponse, error) {
+	v, err := ka.q.pop(ka.ctx, ka.cn, nil)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*pb.LeaseKeepAliveResponse), nil
+}
+
+func (ka *keepAliveStream) push(resp *pb.LeaseKeepAliveResponse) {
+	ka.q.push(resp)
+}
+
+func (ka *keepAliveStream) sent(id int64) bool {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	_, ok := ka.ids[id]
+	return ok
+}
@@ -0,0 +1,196 @@
+package registrytest
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+)
+
+var _ pb.WatchClient = (*conn)(nil)
+
+// Watch 总是返回 stream，若返回错误，clientv3 会不停重试。分区开始时之前建立的
+// stream 断开，clientv3 会建立新的 stream 并从断开处恢复，新的 stream 在分区期间收不到任何消息
+func (cn *conn) Watch(ctx context.Context, opts ...grpc.CallOption) (pb.Watch_WatchClient, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	ws := &watchStream{
+		clientStream: clientStream{ctx: ctx},
+		cn:           cn,
+		q:            newQueue(),
+		brokenC:      cn.broken(),
+		watchers:     make(map[int64]*watcher),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ws.brokenC:
+		}
+		ws.cancelAll()
+	}()
+	return ws, nil
+}
+
+type watchStream struct {
+	clientStream
+	cn      *conn
+	q       *queue
+	brokenC <-chan struct{}
+
+	mu       sync.Mutex
+	nextID   int64
+	watchers map[int64]*watcher
+}
+
+type watcher struct {
+	ws       *watchStream
+	id       int64
+	start    int64
+	key, end []byte
+	prevKV   bool
+	noPut    bool
+	noDelete bool
+}
+
+func (ws *watchStream) Send(req *pb.WatchRequest) error {
+	if err := ctxErr(ws.ctx); err != nil {
+		return err
+	}
+	select {
+	case <-ws.brokenC:
+		return errPartitioned
+	default:
+	}
+	switch r := req.RequestUnion.(type) {
+	case *pb.WatchRequest_CreateRequest:
+		// 分区期间的创建在恢复后生效
+		if healC := ws.cn.healed(); healC != nil {
+			go func() {
+				select {
+				case <-healC:
+					ws.create(r.CreateRequest)
+				case <-ws.ctx.Done():
+				}
+			}()
+			return nil
+		}
+		ws.create(r.CreateRequest)
+	case *pb.WatchRequest_CancelRequest:
+		ws.cancel(r.CancelRequest.WatchId)
+	}
+	return nil
+}
+
+func (ws *watchStream) Recv() (*pb.WatchResponse, error) {
+	v, err := ws.q.pop(ws.ctx, ws.cn, ws.brokenC)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*pb.WatchResponse), nil
+}
+
+func (ws *watchStream) create(in *pb.WatchCreateRequest) {
+	e := ws.cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ws.mu.Lock()
+	w := &watcher{ws: ws, id: ws.nextID, key: in.Key, end: in.RangeEnd, prevKV: in.PrevKv}
+	ws.nextID++
+	ws.mu.Unlock()
+	for _, f := range in.Filters {
+		switch f {
+		case pb.WatchCreateRequest_NOPUT:
+			w.noPut = true
+		case pb.WatchCreateRequest_NODELETE:
+			w.noDelete = true
+		}
+	}
+
+	ws.q.push(&pb.WatchResponse{Header: e.header(), WatchId: w.id, Created: true})
+
+	// 与 etcd 一致，起始版本已被压缩时在创建后取消，并带上压缩的版本
+	start := in.StartRevision
+	if start > 0 && start <= e.compactRev {
+		ws.q.push(&pb.WatchResponse{
+			Header:          e.header(),
+			WatchId:         w.id,
+			Canceled:        true,
+			CompactRevision: e.compactRev,
+		})
+		return
+	}
+
+	w.start = start
+	if start <= 0 {
+		w.start = e.rev + 1
+	}
+	ws.mu.Lock()
+	ws.watchers[w.id] = w
+	ws.mu.Unlock()
+	e.watchers[w] = struct{}{}
+
+	if w.start <= e.rev {
+		var evs []*mvccpb.Event
+		for _, ev := range e.history {
+			if ev.Kv.ModRevision >= start {
+				evs = append(evs, ev)
+			}
+		}
+		w.notify(e.header(), evs)
+	}
+}
+
+func (ws *watchStream) cancel(id int64) {
+	e := ws.cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ws.mu.Lock()
+	w, ok := ws.watchers[id]
+	delete(ws.watchers, id)
+	ws.mu.Unlock()
+	if !ok {
+		return
+	}
+	delete(e.watchers, w)
+	ws.q.push(&pb.WatchResponse{Header: e.header(), WatchId: id, Canceled: true})
+}
+
+func (ws *watchStream) cancelAll() {
+	e := ws.cn.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for id, w := range ws.watchers {
+		delete(e.watchers, w)
+		delete(ws.watchers, id)
+	}
+}
+
+// notify 推送匹配的事件，须持有 e.mu
+func (w *watcher) notify(h *pb.ResponseHeader, evs []*mvccpb.Event) {
+	var matched []*mvccpb.Event
+	for _, ev := range evs {
+		if ev.Kv.ModRevision < w.start || !inRange(ev.Kv.Key, w.key, w.end) {
+			continue
+		}
+		if (ev.Type == mvccpb.PUT && w.noPut) || (ev.Type == mvccpb.DELETE && w.noDelete) {
+			continue
+		}
+		c := *ev
+		if !w.prevKV {
+			c.PrevKv = nil
+		}
+		matched = append(matched, &c)
+	}
+	if len(matched) == 0 {
+		return
+	}
+	w.ws.q.push(&pb.WatchResponse{Header: h, WatchId: w.id, Events: matched})
+}
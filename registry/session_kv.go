@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"context"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/molon/pkg/errors"
+)
+
+// Put puts key bound to the session lease, so it is deleted when the session
+// is closed or expires.
+func (s *Session) Put(ctx context.Context, key, val string) error {
+	_, err := s.client.Put(ctx, key, val, v3.WithLease(s.id))
+	return errors.WithStack(err)
+}
+
+// Get gets the value of key, false if it does not exist.
+func (s *Session) Get(ctx context.Context, key string) (string, bool, error) {
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return "", false, nil
+	}
+	return string(resp.Kvs[0].Value), true, nil
+}
+
+// Delete deletes key.
+func (s *Session) Delete(ctx context.Context, key string) error {
+	_, err := s.client.Delete(ctx, key)
+	return errors.WithStack(err)
+}
+
+// Watch watches key with opts, e.g. clientv3.WithPrefix. The channel is
+// closed when ctx is done or the session ends.
+func (s *Session) Watch(ctx context.Context, key string, opts ...v3.OpOption) v3.WatchChan {
+	ctx, cancel := sessionContext(ctx, s)
+	wch := s.client.Watch(ctx, key, opts...)
+	retc := make(chan v3.WatchResponse)
+	go func() {
+		defer close(retc)
+		defer cancel()
+		for wr := range wch {
+			select {
+			case retc <- wr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return retc
+}
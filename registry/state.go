@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// RegisterState is the state of a Register.
+type RegisterState uint8
+
+const (
+	// Registering is the state before the first registration succeeds.
+	Registering RegisterState = iota + 1
+	// Registered means the key is published under a live lease.
+	Registered
+	// SessionLost means the session of the registration has expired.
+	SessionLost
+	// Reregistering is the state after SessionLost until registered again.
+	Reregistering
+	// Closed means the Register is closed and the key is withdrawn.
+	Closed
+	// Withdrawn means the session is live but the key is withdrawn, because
+	// the readiness check of WithReadiness fails.
+	Withdrawn
+)
+
+func (s RegisterState) String() string {
+	switch s {
+	case Registering:
+		return "Registering"
+	case Registered:
+		return "Registered"
+	case SessionLost:
+		return "SessionLost"
+	case Reregistering:
+		return "Reregistering"
+	case Closed:
+		return "Closed"
+	case Withdrawn:
+		return "Withdrawn"
+	default:
+		return "Unknown"
+	}
+}
+
+// RegisterStatus is a snapshot of the registration status.
+type RegisterStatus struct {
+	State RegisterState
+	// Err is the last error of registering, nil once registered.
+	Err error
+	// Lease is the lease of the current or, if SessionLost, the lost session.
+	Lease clientv3.LeaseID
+	Time  time.Time
+}
+
+// statusSubBuffer 订阅者的缓冲，满时丢弃最旧的状态，保证最新的状态一定能被收到
+const statusSubBuffer = 16
+
+type statusHub struct {
+	mu     sync.Mutex
+	status RegisterStatus
+	subs   map[chan RegisterStatus]struct{}
+	closed bool
+}
+
+func newStatusHub() *statusHub {
+	return &statusHub{
+		status: RegisterStatus{State: Registering, Time: time.Now()},
+		subs:   make(map[chan RegisterStatus]struct{}),
+	}
+}
+
+func (h *statusHub) get() RegisterStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// set 更新状态并通知订阅者，Closed 之后不再变化
+func (h *statusHub) set(state RegisterState, err error, lease clientv3.LeaseID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	if h.status.State == state && h.status.Err == err && h.status.Lease == lease {
+		return
+	}
+	h.status = RegisterStatus{State: state, Err: err, Lease: lease, Time: time.Now()}
+	for ch := range h.subs {
+		send(ch, h.status)
+	}
+	if state == Closed {
+		h.closed = true
+		for ch := range h.subs {
+			close(ch)
+		}
+		h.subs = nil
+	}
+}
+
+func send(ch chan RegisterStatus, st RegisterStatus) {
+	for {
+		select {
+		case ch <- st:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+func (h *statusHub) subscribe() (<-chan RegisterStatus, func()) {
+	ch := make(chan RegisterStatus, statusSubBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch <- h.status
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if _, ok := h.subs[ch]; ok {
+				delete(h.subs, ch)
+				close(ch)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package retry
+
+import (
+	"context"
+
+	"github.com/molon/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryClientInterceptor retries the calls with r while they fail with one of
+// retryCodes, codes.Unavailable if none is given. The method is the name
+// passed to the log of r.
+func UnaryClientInterceptor(r *Retry, retryCodes ...codes.Code) grpc.UnaryClientInterceptor {
+	if len(retryCodes) <= 0 {
+		retryCodes = []codes.Code{codes.Unavailable}
+	}
+	retryable := make(map[codes.Code]bool, len(retryCodes))
+	for _, c := range retryCodes {
+		retryable[c] = true
+	}
+
+	return func(
+		ctx context.Context,
+		method string,
+		req, resp interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		// fix 返回错误时 Do 会直接返回，以此终止不可重试的错误
+		fix := r.fix
+		return r.Do(ctx, method, func(ctx context.Context, idx int) error {
+			return invoker(ctx, method, req, resp, cc, opts...)
+		}, WithFix(func(ctx context.Context, name string, idx int, err error) error {
+			if !retryable[status.Code(errors.Cause(err))] {
+				return err
+			}
+			if fix != nil {
+				return fix(ctx, name, idx, err)
+			}
+			return nil
+		}))
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"context"
 
 	"github.com/molon/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestRetry(t *testing.T) {
@@ -36,3 +39,26 @@ func TestRetry(t *testing.T) {
 		log.Println("FINAL:", err)
 	}
 }
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	interceptor := UnaryClientInterceptor(New(WithN(3), WithLog(NewLog(nil))))
+
+	calls := 0
+	invoker := func(code codes.Code) grpc.UnaryInvoker {
+		return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			calls++
+			return status.Error(code, "failed")
+		}
+	}
+
+	interceptor(context.Background(), "/test", nil, nil, nil, invoker(codes.Unavailable))
+	if calls != 3 {
+		t.Fatalf("expected 3 calls for Unavailable, got %d", calls)
+	}
+
+	calls = 0
+	interceptor(context.Background(), "/test", nil, nil, nil, invoker(codes.InvalidArgument))
+	if calls != 1 {
+		t.Fatalf("expected 1 call for InvalidArgument, got %d", calls)
+	}
+}
@@ -1,6 +1,7 @@
 package health
 
 import (
+	"fmt"
 	"net/http"
 	"sync"
 
@@ -25,6 +26,24 @@ type Checker interface {
 	RegisterHandler(mux *http.ServeMux)
 }
 
+// ReadinessChecker is implemented by the Checker which can combine its readiness checks into one Check, as the one
+// of NewChecksHandler does.
+type ReadinessChecker interface {
+	// ReadinessCheck returns a Check which fails if any of the readiness checks fails
+	ReadinessCheck() Check
+}
+
+// ReadinessCheck returns the Check combining the readiness checks of checker. If checker does not implement
+// ReadinessChecker, the Check always fails.
+func ReadinessCheck(checker Checker) Check {
+	if rc, ok := checker.(ReadinessChecker); ok {
+		return rc.ReadinessCheck()
+	}
+	return func() error {
+		return fmt.Errorf("health: %T does not implement ReadinessChecker", checker)
+	}
+}
+
 // NewChecksHandler accepts two strings: health and ready paths.
 // These paths will be used for liveness and readiness checks.
 func NewChecksHandler(healthzPath, readyPath string) Checker {
@@ -58,6 +77,23 @@ func (ch *checksHandler) AddReadiness(name string, check Check) {
 	ch.readinessChecks[name] = check
 }
 
+func (ch *checksHandler) ReadinessCheck() Check {
+	return func() error {
+		ch.lock.RLock()
+		defer ch.lock.RUnlock()
+
+		for name, check := range ch.readinessChecks {
+			if check == nil {
+				continue
+			}
+			if err := check(); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		return nil
+	}
+}
+
 // Handler returns a new http.Handler for the given health checker
 func (ch *checksHandler) Handler() http.Handler {
 	mux := http.NewServeMux()
@@ -0,0 +1,27 @@
+package health
+
+import (
+	"errors"
+	"testing"
+)
+
+type plainChecker struct{ Checker }
+
+func TestReadinessCheck(t *testing.T) {
+	checker := NewChecksHandler("/healthz", "/ready")
+	check := ReadinessCheck(checker)
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+
+	checker.AddReadiness("db", func() error { return errors.New("down") })
+	checker.AddLiveness("loop", func() error { return errors.New("ignored") })
+	if err := check(); err == nil || err.Error() != "db: down" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// 未实现 ReadinessChecker 的 Checker 总是失败
+	if err := ReadinessCheck(plainChecker{checker})(); err == nil {
+		t.Fatal("nil error")
+	}
+}
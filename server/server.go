@@ -181,7 +181,9 @@ func (s *Server) Serve(grpcL, httpL net.Listener) error {
 			}
 		}()
 	} else {
+		s.mu.Lock()
 		s.HTTPServer = nil
+		s.mu.Unlock()
 	}
 
 	if grpcL != nil {
@@ -190,7 +192,9 @@ func (s *Server) Serve(grpcL, httpL net.Listener) error {
 		}
 		go func() { errC <- s.GRPCServer.Serve(grpcL) }()
 	} else {
+		s.mu.Lock()
 		s.GRPCServer = nil
+		s.mu.Unlock()
 	}
 	defer s.Stop()
 	return <-errC
@@ -198,49 +202,54 @@ func (s *Server) Serve(grpcL, httpL net.Listener) error {
 
 // Stop immediately terminates the grpc and http servers
 func (s *Server) Stop() error {
+	return s.stop(context.Background())
+}
+
+// stop 优雅停止，最多等待10秒或到 ctx 结束，之后强制停止
+func (s *Server) stop(ctx context.Context) error {
 	s.mu.Lock()
 	if s.stopped {
 		s.mu.Unlock()
 		return nil
 	}
 	s.stopped = true
+	// Serve 可能同时修改
+	grpcServer, httpServer := s.GRPCServer, s.HTTPServer
 	s.mu.Unlock()
 
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	errC := make(chan error, 1)
 	go func() {
 		defer wg.Done()
 
-		if s.GRPCServer != nil {
-			// 先尝试GracefulStop，10秒还不成，再强制Stop
+		if grpcServer != nil {
+			// 先尝试GracefulStop，超时还不成，再强制Stop
 			stopped := make(chan struct{})
 			go func() {
-				s.GRPCServer.GracefulStop()
+				grpcServer.GracefulStop()
 				close(stopped)
 			}()
-			t := time.NewTimer(10 * time.Second)
 			select {
-			case <-t.C:
-				s.GRPCServer.Stop()
+			case <-ctx.Done():
+				grpcServer.Stop()
 			case <-stopped:
-				t.Stop()
 			}
 		}
 	}()
 	go func() {
 		defer wg.Done()
-		if s.HTTPServer != nil {
-			// 尝试Shutdown，超时10秒
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-			if err := s.HTTPServer.Shutdown(ctx); err != nil {
-				if err != context.DeadlineExceeded {
+		if httpServer != nil {
+			// 尝试Shutdown，超时则再尝试一发Close
+			if err := httpServer.Shutdown(ctx); err != nil {
+				if ctx.Err() == nil {
 					errC <- err
 					return
 				}
-				// 如果是因为超时，则再尝试一发Close
-				if err := s.HTTPServer.Close(); err != nil {
+				if err := httpServer.Close(); err != nil {
 					errC <- err
 				}
 			}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/molon/pkg/server/health"
+)
+
+var (
+	// ErrShuttingDown is returned by the readiness check of Shutdown once the instance has deregistered
+	ErrShuttingDown = errors.New("server is shutting down")
+	// DefaultShutdownDelay is the time the watchers of the registry are expected to take to converge after an
+	// instance deregisters
+	DefaultShutdownDelay = 3 * time.Second
+)
+
+// Deregisterer withdraws the instance from service discovery, e.g. *registry.Register whose Close revokes the lease.
+type Deregisterer interface {
+	Close()
+}
+
+// Shutdown coordinates the graceful shutdown of an instance, so that clients stop dialing it before it stops serving.
+// The recommended way to initialize this is with the NewShutdown function.
+type Shutdown struct {
+	delay         time.Duration
+	deregisterers []Deregisterer
+	servers       []*Server
+
+	shuttingDown int32
+	once         sync.Once
+	doneC        chan struct{}
+	err          error
+}
+
+// ShutdownOption is a functional option for creating a Shutdown
+type ShutdownOption func(*Shutdown)
+
+// NewShutdown creates a Shutdown from the given options.
+func NewShutdown(opts ...ShutdownOption) *Shutdown {
+	sd := &Shutdown{
+		delay: DefaultShutdownDelay,
+		doneC: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(sd)
+	}
+	return sd
+}
+
+// WithShutdownDelay sets how long to wait after deregistering before stopping the servers.
+// If not set, DefaultShutdownDelay will be used.
+func WithShutdownDelay(delay time.Duration) ShutdownOption {
+	return func(sd *Shutdown) {
+		sd.delay = delay
+	}
+}
+
+// WithDeregisterer adds the registrations to withdraw first on shutdown.
+func WithDeregisterer(deregisterers ...Deregisterer) ShutdownOption {
+	return func(sd *Shutdown) {
+		sd.deregisterers = append(sd.deregisterers, deregisterers...)
+	}
+}
+
+// WithShutdownServers adds the servers to stop last on shutdown.
+func WithShutdownServers(svcs ...*Server) ShutdownOption {
+	return func(sd *Shutdown) {
+		sd.servers = append(sd.servers, svcs...)
+	}
+}
+
+// WithShutdownReadiness adds the ReadinessCheck of the Shutdown to the given health checker under "shutdown".
+func WithShutdownReadiness(checker health.Checker) ShutdownOption {
+	return func(sd *Shutdown) {
+		checker.AddReadiness("shutdown", sd.ReadinessCheck())
+	}
+}
+
+// ReadinessCheck returns a check which fails with ErrShuttingDown once the instance has deregistered.
+func (sd *Shutdown) ReadinessCheck() health.Check {
+	return func() error {
+		if atomic.LoadInt32(&sd.shuttingDown) != 0 {
+			return ErrShuttingDown
+		}
+		return nil
+	}
+}
+
+// Run shuts down in order: closes the deregisterers, flips the readiness check to failing, waits for the shutdown
+// delay, and stops the servers gracefully. The readiness check fails before the delay rather than after it, so that
+// load balancers relying on readiness drain the instance during the delay as well as the registry watchers.
+// ctx bounds the whole shutdown: if it is done while closing the deregisterers or during the delay, Run stops
+// waiting and goes on, and if it is done while stopping gracefully, the servers are stopped immediately.
+// Only the first call runs the shutdown, the others wait for it to finish.
+func (sd *Shutdown) Run(ctx context.Context) error {
+	sd.once.Do(func() {
+		defer close(sd.doneC)
+
+		// 先撤销注册，使客户端不再拨号到本实例
+		// etcd 不可达时 Close 可能一直阻塞，ctx 结束则不再等待
+		deregistered := make(chan struct{})
+		go func() {
+			defer close(deregistered)
+			wg := sync.WaitGroup{}
+			wg.Add(len(sd.deregisterers))
+			for _, d := range sd.deregisterers {
+				go func(d Deregisterer) {
+					defer wg.Done()
+					d.Close()
+				}(d)
+			}
+			wg.Wait()
+		}()
+		select {
+		case <-ctx.Done():
+		case <-deregistered:
+		}
+
+		// 负载均衡等依赖就绪检查的也开始摘除本实例
+		atomic.StoreInt32(&sd.shuttingDown, 1)
+
+		// 等待各个watcher收敛
+		if sd.delay > 0 {
+			t := time.NewTimer(sd.delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+			case <-t.C:
+			}
+		}
+
+		errC := make(chan error, len(sd.servers))
+		wg := sync.WaitGroup{}
+		wg.Add(len(sd.servers))
+		for _, svc := range sd.servers {
+			go func(svc *Server) {
+				defer wg.Done()
+				if err := svc.stop(ctx); err != nil {
+					errC <- err
+				}
+			}(svc)
+		}
+		wg.Wait()
+		close(errC)
+		sd.err = <-errC
+	})
+
+	<-sd.doneC
+	return sd.err
+}
+
+// Done returns a channel which is closed when the shutdown has finished.
+func (sd *Shutdown) Done() <-chan struct{} { return sd.doneC }
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+	times  map[string]time.Time
+}
+
+func (r *recorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.times[event]; ok {
+		return
+	}
+	r.events = append(r.events, event)
+	r.times[event] = time.Now()
+}
+
+type deregisterFunc func()
+
+func (f deregisterFunc) Close() { f() }
+
+func serveGRPC(t *testing.T) (*Server, string, <-chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+	svc, err := NewServer(WithGRPCServer(gs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servedC := make(chan struct{})
+	go func() {
+		defer close(servedC)
+		svc.Serve(l, nil)
+	}()
+	return svc, l.Addr().String(), servedC
+}
+
+func TestShutdownOrder(t *testing.T) {
+	svc, _, servedC := serveGRPC(t)
+
+	rec := &recorder{times: make(map[string]time.Time)}
+	var sd *Shutdown
+	sd = NewShutdown(
+		WithShutdownDelay(200*time.Millisecond),
+		WithShutdownServers(svc),
+		WithDeregisterer(deregisterFunc(func() {
+			if err := sd.ReadinessCheck()(); err != nil {
+				t.Errorf("not ready before deregistering: %v", err)
+			}
+			rec.record("deregister")
+		})),
+	)
+	check := sd.ReadinessCheck()
+	go func() {
+		for check() == nil {
+			time.Sleep(time.Millisecond)
+		}
+		rec.record("unready")
+	}()
+	go func() {
+		<-servedC
+		rec.record("stopped")
+	}()
+
+	if err := sd.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-servedC
+	time.Sleep(10 * time.Millisecond)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.events) != 3 || rec.events[0] != "deregister" || rec.events[1] != "unready" || rec.events[2] != "stopped" {
+		t.Fatalf("unexpected order %v", rec.events)
+	}
+	if d := rec.times["stopped"].Sub(rec.times["unready"]); d < 150*time.Millisecond {
+		t.Fatalf("stopped %v after readiness failed, want the delay", d)
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	svc, addr, servedC := serveGRPC(t)
+
+	// 未结束的 stream 使 GracefulStop 一直等待
+	cc, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	stream, err := healthpb.NewHealthClient(cc).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	sd := NewShutdown(WithShutdownDelay(time.Second), WithShutdownServers(svc))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sd.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown took %v after ctx was done", d)
+	}
+	<-servedC
+}
+
+func TestShutdownDeregisterContext(t *testing.T) {
+	svc, _, servedC := serveGRPC(t)
+
+	// 例如 etcd 不可达时的 Register.Close
+	blockC := make(chan struct{})
+	defer close(blockC)
+	sd := NewShutdown(
+		WithShutdownDelay(time.Second),
+		WithShutdownServers(svc),
+		WithDeregisterer(deregisterFunc(func() { <-blockC })),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sd.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown took %v after ctx was done", d)
+	}
+	if err := sd.ReadinessCheck()(); err != ErrShuttingDown {
+		t.Fatalf("unexpected readiness %v", err)
+	}
+	<-servedC
+}
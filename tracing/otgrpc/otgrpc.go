@@ -3,8 +3,10 @@ package otgrpc
 import (
 	"context"
 	"fmt"
+	"io"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
@@ -236,6 +238,130 @@ func UnaryClientInterceptor(options ...TracingOption) grpc.UnaryClientIntercepto
 	}
 }
 
+// StreamClientInterceptor traces a client stream with one span, which is
+// finished when the stream ends. Request and response bodies are not traced.
+func StreamClientInterceptor(options ...TracingOption) grpc.StreamClientInterceptor {
+	tOpts := &tracingOptions{}
+	for _, opt := range options {
+		opt(tOpts)
+	}
+
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		if !opentracing.IsGlobalTracerRegistered() {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		if opentracing.SpanFromContext(ctx) == nil {
+			//如果ctx里没传，就从gls获取
+			glsSpan := tracing.GetGlsTracingSpan()
+			if glsSpan != nil {
+				ctx = opentracing.ContextWithSpan(ctx, glsSpan)
+			}
+		}
+
+		var parentCtx opentracing.SpanContext
+		if parent := opentracing.SpanFromContext(ctx); parent != nil {
+			parentCtx = parent.Context()
+		}
+
+		var op string
+		if tOpts.opNameFunc != nil {
+			op = tOpts.opNameFunc()
+		}
+		if op == "" {
+			op = fmt.Sprintf("GRPC_CLI_STREAM %s", method)
+		}
+		sp := opentracing.GlobalTracer().StartSpan(
+			op,
+			opentracing.ChildOf(parentCtx),
+			ext.SpanKindRPCClient,
+		)
+		ext.Component.Set(sp, "grpc")
+
+		//设置carrier
+		md, ok := metadata.FromOutgoingContext(ctx)
+		if !ok {
+			md = metadata.New(nil)
+		} else {
+			md = md.Copy()
+		}
+		mdWriter := metadataReaderWriter{md}
+		if err := sp.Tracer().Inject(sp.Context(), opentracing.HTTPHeaders, mdWriter); err != nil {
+			ext.Error.Set(sp, true)
+			sp.LogFields(tracing.ErrorField(errors.Wrap(err, "Tracer.Inject() failed")))
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+		traceMD(sp, md)
+
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			eco.SetSpanTags(sp, err, true)
+			sp.LogFields(tracing.ErrorField(errors.Wrap(err, "Streamer failed")))
+			sp.Finish()
+			return nil, err
+		}
+		return &tracedClientStream{ClientStream: cs, sp: sp, desc: desc}, nil
+	}
+}
+
+// tracedClientStream 在流结束时结束span
+type tracedClientStream struct {
+	grpc.ClientStream
+	sp   opentracing.Span
+	desc *grpc.StreamDesc
+	once sync.Once
+}
+
+func (s *tracedClientStream) finish(err error) {
+	s.once.Do(func() {
+		if err != nil && err != io.EOF {
+			eco.SetSpanTags(s.sp, err, true)
+			s.sp.LogFields(tracing.ErrorField(errors.Wrap(err, "Stream failed")))
+		}
+		s.sp.Finish()
+	})
+}
+
+func (s *tracedClientStream) Header() (metadata.MD, error) {
+	md, err := s.ClientStream.Header()
+	if err != nil {
+		s.finish(err)
+	}
+	return md, err
+}
+
+func (s *tracedClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err != nil {
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *tracedClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil || !s.desc.ServerStreams {
+		// 非服务端流在收到唯一的响应后即结束
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *tracedClientStream) CloseSend() error {
+	err := s.ClientStream.CloseSend()
+	if err != nil {
+		s.finish(err)
+	}
+	return err
+}
+
 func traceRequest(sp opentracing.Span, req interface{}, maxBodyLogSize int) {
 	jsn, err := marshalBodyToString(req)
 	if err != nil {